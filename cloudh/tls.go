@@ -3,16 +3,22 @@ package cloudh
 import (
 	"context"
 	"crypto"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/registration"
 	consulapi "github.com/hashicorp/consul/api"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/qbart/ohowl/tea"
 )
 
 type TlsStorage interface {
@@ -20,35 +26,92 @@ type TlsStorage interface {
 	Write(ctx context.Context, key string, b []byte) error
 	Read(ctx context.Context, key string) ([]byte, error)
 	Find(ctx context.Context, key string, ext string) ([]string, error)
+	Delete(ctx context.Context, key string) error
 }
 
-type TlsFileStorage struct{}
+type TlsFileStorage struct {
+	// Perms by file extension (".key", ".crt", ...), "" applies to all files.
+	Perms map[string]TlsFilePerm
+}
+
+// TlsFilePerm describes mode and ownership of written files.
+// Zero Mode and negative Uid/Gid are left unset.
+type TlsFilePerm struct {
+	Mode os.FileMode
+	Uid  int
+	Gid  int
+}
 type TlsConsulStorage struct {
-	KV *consulapi.KV
+	KV      *consulapi.KV
+	Session *consulapi.Session
+}
+type TlsVaultStorage struct {
+	Logical   *vaultapi.Logical
+	Mount     string
+	KVVersion int
 }
-type TlsVaultStorage struct{}
 type TlsNullStorage struct{}
 
 type TlsConfig struct {
-	DnsToken          string
-	Email             string
-	AccountPathPrefix string
-	CertPathPrefix    string
-	Domains           []string
-	Debug             bool
+	DnsToken            string
+	DnsProvider         string
+	DnsProviders        map[string]string
+	Dns                 TlsDnsOptions
+	Challenge           string
+	ChallengePathPrefix string
+	Email               string
+	AccountPathPrefix   string
+	CertPathPrefix      string
+	Domains             []string
+	Debug               bool
+	AcmeDirectory       string
+	EabKid              string
+	EabHmac             string
+	CaBundle            string
+	KeyType             certcrypto.KeyType
+	AccountKeyType      certcrypto.KeyType
+	ArchiveRevoked      bool
+	// RenewDays before expiry to renew, nil means 30 (0 renews on the last day).
+	RenewDays      *int
+	DomainsChanged string
+	Deploy         map[string][]TlsDeployTarget
+	LockWait       bool
+	// SkipPreflight disables CAA/zone/IDNA checks before ordering.
+	SkipPreflight bool
+	// PreflightProbe checks Hetzner zone is editable by creating and removing
+	// a _owl-preflight TXT record, otherwise the zone only has to be visible.
+	PreflightProbe bool
 }
 
 type AutoTls struct {
 	Config         TlsConfig
 	Storage        TlsStorage
 	AccountStorage TlsStorage
+	// Issuer signs certificates, ACME when nil.
+	Issuer TlsIssuer
+	// Context aborts pending orders when cancelled, context.Background() when nil.
+	Context context.Context
 }
 
 type TlsCert struct {
-	CommonName string
-	DNS        []string
-	Expiry     time.Time
-	Path       string
+	CommonName string       `json:"common_name"`
+	DNS        []string     `json:"dns"`
+	Expiry     time.Time    `json:"expiry"`
+	DaysLeft   int          `json:"days_left"`
+	Path       string       `json:"path"`
+	KeyType    string       `json:"key_type"`
+	Issuer     string       `json:"issuer"`
+	Serial     string       `json:"serial"`
+	KeyMatch   *bool        `json:"key_match,omitempty"` // set by CheckKeys
+	Csr        bool         `json:"csr,omitempty"`       // issued from CSR, key is kept by the caller
+	Meta       *TlsCertMeta `json:"meta,omitempty"`
+	Order      *TlsOrder    `json:"order,omitempty"`
+}
+
+type TlsRenewResult struct {
+	Domain  string
+	Renewed bool
+	Err     error
 }
 
 type AcmeUser struct {
@@ -57,6 +120,22 @@ type AcmeUser struct {
 	key          crypto.PrivateKey
 }
 
+// Policies of Renew when requested domains differ from certificate SANs.
+const (
+	TlsDomainsFail    = "fail"
+	TlsDomainsMerge   = "merge"
+	TlsDomainsReplace = "replace"
+)
+
+// Revocation reason codes (RFC 5280, section 5.3.1) accepted by ACME CAs.
+var TlsRevocationReasons = map[string]uint{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+}
+
 func TlsStorageById(id string) TlsStorage {
 	switch id {
 	case "consul":
@@ -88,6 +167,10 @@ func (fs *TlsNullStorage) Find(ctx context.Context, key string, ext string) ([]s
 	return nil, errors.New("Empty storage for .Find")
 }
 
+func (fs *TlsNullStorage) Delete(ctx context.Context, key string) error {
+	return errors.New("Empty storage for .Delete")
+}
+
 // ----- TlsFileStorage -----
 
 func (fs *TlsFileStorage) Exists(ctx context.Context, key string) (bool, error) {
@@ -99,8 +182,13 @@ func (fs *TlsFileStorage) Exists(ctx context.Context, key string) (bool, error)
 	return true, nil
 }
 
+// Write creates missing directories and replaces the file atomically
+// (temp file + rename). Links into bundle directories are written through.
 func (fs *TlsFileStorage) Write(ctx context.Context, key string, b []byte) error {
-	return ioutil.WriteFile(key, b, 0o644)
+	if resolved, err := filepath.EvalSymlinks(key); err == nil {
+		key = resolved
+	}
+	return fs.writeAtomic(key, b)
 }
 
 func (fs *TlsFileStorage) Read(ctx context.Context, key string) ([]byte, error) {
@@ -108,7 +196,93 @@ func (fs *TlsFileStorage) Read(ctx context.Context, key string) ([]byte, error)
 }
 
 func (fs *TlsFileStorage) Find(ctx context.Context, key string, ext string) ([]string, error) {
-	return filepath.Glob(filepath.Join(key, fmt.Sprint("*", ext)))
+	matches, err := filepath.Glob(filepath.Join(key, fmt.Sprint("*", ext)))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+			res = append(res, match)
+		}
+	}
+	return res, nil
+}
+
+func (fs *TlsFileStorage) Delete(ctx context.Context, key string) error {
+	if ok, err := fs.deleteBundleFile(key); ok {
+		return err
+	}
+	if err := os.Remove(key); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *TlsFileStorage) writeAtomic(name string, b []byte) error {
+	perm := fs.perm(name)
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, fmt.Sprint(".", filepath.Base(name), ".tmp-"))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	err = tea.ErrCoalesce(
+		writeAndSync(f, b),
+		f.Close(),
+		os.Chmod(tmp, perm.Mode),
+	)
+	if err == nil && (perm.Uid >= 0 || perm.Gid >= 0) {
+		err = os.Chown(tmp, perm.Uid, perm.Gid)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// perm merges defaults (0600 for keys and orders, 0644 otherwise) with configured
+// perms for all files and then for the file extension.
+func (fs *TlsFileStorage) perm(name string) TlsFilePerm {
+	// archived files keep their original extension before the suffix
+	ext := filepath.Ext(strings.SplitN(filepath.Base(name), tlsArchiveSuffix, 2)[0])
+
+	perm := TlsFilePerm{Mode: 0o644, Uid: -1, Gid: -1}
+	if ext == ".key" || ext == ".order" {
+		perm.Mode = 0o600
+	}
+	for _, k := range []string{"", ext} {
+		p, ok := fs.Perms[k]
+		if !ok {
+			continue
+		}
+		if p.Mode != 0 {
+			perm.Mode = p.Mode
+		}
+		if p.Uid >= 0 {
+			perm.Uid = p.Uid
+		}
+		if p.Gid >= 0 {
+			perm.Gid = p.Gid
+		}
+	}
+	return perm
+}
+
+func writeAndSync(f *os.File, b []byte) error {
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	return f.Sync()
 }
 
 // ----- TlsConsulStorage -----
@@ -156,22 +330,217 @@ func (fs *TlsConsulStorage) Find(ctx context.Context, key string, ext string) ([
 	return res, nil
 }
 
+func (fs *TlsConsulStorage) Delete(ctx context.Context, key string) error {
+	if _, err := fs.KV.Delete(key, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
 // ----- TlsVaultStorage -----
+//
+// Values are kept base64 encoded under the "value" field of a secret,
+// so binary data survives the JSON round trip. Both KV v1 and KV v2
+// mounts are supported (v2 uses data/ and metadata/ sub-paths).
+//
+// Bundles (see WriteBundle) are single "<stem>.bundle" secrets with one
+// field per extension, "<stem><ext>" keys are resolved to bundle fields
+// first and to plain secrets second.
 
 func (fs *TlsVaultStorage) Exists(ctx context.Context, key string) (bool, error) {
-	return false, errors.New("Not implemented")
+	b, err := fs.read(key)
+	if err != nil {
+		return false, err
+	}
+	return (b != nil), nil
 }
 
 func (fs *TlsVaultStorage) Write(ctx context.Context, key string, b []byte) error {
-	return errors.New("Not implemented")
+	stem, ext := fs.splitKey(key)
+	bundle, err := fs.readSecret(stem + vaultBundleSuffix)
+	if err != nil {
+		return err
+	}
+	if _, ok := bundle[ext]; ok {
+		bundle[ext] = base64.StdEncoding.EncodeToString(b)
+		return fs.writeSecret(stem+vaultBundleSuffix, bundle)
+	}
+
+	return fs.writeSecret(key, map[string]interface{}{"value": base64.StdEncoding.EncodeToString(b)})
 }
 
 func (fs *TlsVaultStorage) Read(ctx context.Context, key string) ([]byte, error) {
-	return nil, errors.New("Not implemented")
+	b, err := fs.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, errors.New("Not found")
+	}
+	return b, nil
 }
 
 func (fs *TlsVaultStorage) Find(ctx context.Context, key string, ext string) ([]string, error) {
-	return nil, errors.New("Not implemented")
+	secret, err := fs.Logical.List(fs.metadataPath(key))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	if secret == nil || secret.Data == nil {
+		return res, nil
+	}
+	seen := make(map[string]bool)
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, k := range keys {
+		name, ok := k.(string)
+		if !ok || strings.HasSuffix(name, "/") {
+			continue
+		}
+
+		names := []string{name}
+		if strings.HasSuffix(name, vaultBundleSuffix) {
+			bundle, err := fs.readSecret(path.Join(key, name))
+			if err != nil {
+				return nil, err
+			}
+			names = names[:0]
+			for field := range bundle {
+				names = append(names, strings.TrimSuffix(name, vaultBundleSuffix)+field)
+			}
+		}
+
+		for _, name := range names {
+			if strings.HasSuffix(name, ext) && !seen[name] {
+				seen[name] = true
+				res = append(res, path.Join(key, name))
+			}
+		}
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// Delete removes the secret with all its versions (KV v2)
+// or the field of a bundle the key belongs to.
+func (fs *TlsVaultStorage) Delete(ctx context.Context, key string) error {
+	stem, ext := fs.splitKey(key)
+	bundle, err := fs.readSecret(stem + vaultBundleSuffix)
+	if err != nil {
+		return err
+	}
+	if _, ok := bundle[ext]; ok {
+		delete(bundle, ext)
+		if len(bundle) == 0 {
+			err = fs.deleteSecret(stem + vaultBundleSuffix)
+		} else {
+			err = fs.writeSecret(stem+vaultBundleSuffix, bundle)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return fs.deleteSecret(key)
+}
+
+// read returns nil bytes when the key does not exist
+// (or was soft deleted in KV v2).
+func (fs *TlsVaultStorage) read(key string) ([]byte, error) {
+	stem, ext := fs.splitKey(key)
+	bundle, err := fs.readSecret(stem + vaultBundleSuffix)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := bundle[ext]
+	if !ok {
+		data, err := fs.readSecret(key)
+		if err != nil || data == nil {
+			return nil, err
+		}
+		if value, ok = data["value"]; !ok {
+			return nil, fmt.Errorf("Vault secret %s has no value", key)
+		}
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("Vault secret %s has invalid value", key)
+	}
+	return base64.StdEncoding.DecodeString(str)
+}
+
+func (fs *TlsVaultStorage) readSecret(key string) (map[string]interface{}, error) {
+	secret, err := fs.Logical.Read(fs.dataPath(key))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	data := secret.Data
+	if fs.KVVersion == 2 {
+		inner, ok := data["data"].(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		data = inner
+	}
+	return data, nil
+}
+
+func (fs *TlsVaultStorage) writeSecret(key string, data map[string]interface{}) error {
+	if fs.KVVersion == 2 {
+		data = map[string]interface{}{"data": data}
+	}
+	if _, err := fs.Logical.Write(fs.dataPath(key), data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fs *TlsVaultStorage) deleteSecret(key string) error {
+	if _, err := fs.Logical.Delete(fs.metadataPath(key)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fs *TlsVaultStorage) splitKey(key string) (string, string) {
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext), ext
+}
+
+func (fs *TlsVaultStorage) dataPath(key string) string {
+	if fs.KVVersion == 2 {
+		return path.Join(fs.Mount, "data", key)
+	}
+	return path.Join(fs.Mount, key)
+}
+
+func (fs *TlsVaultStorage) metadataPath(key string) string {
+	if fs.KVVersion == 2 {
+		return path.Join(fs.Mount, "metadata", key)
+	}
+	return path.Join(fs.Mount, key)
+}
+
+// ----- TlsCert -----
+
+// Domains returns common name followed by the rest of SANs
+// (same order as certcrypto.ExtractDomains).
+func (c *TlsCert) Domains() []string {
+	domains := make([]string, 0, len(c.DNS)+1)
+	if c.CommonName != "" {
+		domains = append(domains, c.CommonName)
+	}
+	for _, name := range c.DNS {
+		if name != c.CommonName {
+			domains = append(domains, name)
+		}
+	}
+	return domains
 }
 
 // ----- AcmeUser -----
@@ -0,0 +1,464 @@
+package cloudh
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/registration"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const tlsAccountDeactivated = "deactivated"
+
+// TlsAccount describes ACME account stored in AccountStorage.
+type TlsAccount struct {
+	Email     string   `json:"email"`
+	URI       string   `json:"uri,omitempty"`
+	Status    string   `json:"status,omitempty"`
+	Contact   []string `json:"contact,omitempty"`
+	KeyType   string   `json:"key_type"`
+	Path      string   `json:"path"`
+	Directory string   `json:"directory"`
+}
+
+// ShowAccount returns stored account, refreshed from the CA when registered.
+func (at *AutoTls) ShowAccount() (*TlsAccount, error) {
+	user, err := at.existingUser()
+	if err != nil {
+		return nil, err
+	}
+	if user.Registration != nil && user.Registration.Body.Status != tlsAccountDeactivated {
+		client, err := at.newClient(user, at.keyType())
+		if err != nil {
+			return nil, err
+		}
+		if user.Registration, err = client.Registration.QueryRegistration(); err != nil {
+			return nil, err
+		}
+	}
+	return at.account(user), nil
+}
+
+// RegisterAccount creates account key (when missing) and registers it at the CA.
+func (at *AutoTls) RegisterAccount() (*TlsAccount, error) {
+	user, err := at.loadUser()
+	if err != nil {
+		return nil, err
+	}
+	if user.Registration != nil {
+		return nil, fmt.Errorf("Account is already registered: %s", user.Registration.URI)
+	}
+
+	client, err := at.newClient(user, at.keyType())
+	if err != nil {
+		return nil, err
+	}
+	if user.Registration, err = at.register(client); err != nil {
+		return nil, err
+	}
+	if err = at.saveAccount(user); err != nil {
+		return nil, err
+	}
+	return at.account(user), nil
+}
+
+// UpdateAccountEmail changes account contact at the CA and moves
+// stored account to paths of the new email.
+func (at *AutoTls) UpdateAccountEmail(email string) error {
+	user, err := at.registeredUser()
+	if err != nil {
+		return err
+	}
+
+	user.Email = email
+	client, err := at.newClient(user, at.keyType())
+	if err != nil {
+		return err
+	}
+	if user.Registration, err = client.Registration.UpdateRegistration(registration.RegisterOptions{TermsOfServiceAgreed: true}); err != nil {
+		return err
+	}
+
+	moved := *at
+	moved.Config.Email = email
+	keyPem, err := at.AccountStorage.Read(context.TODO(), at.accountFileName(at.Config.Email, ".key"))
+	if err != nil {
+		return err
+	}
+	if err = moved.AccountStorage.Write(context.TODO(), moved.accountFileName(email, ".key"), keyPem); err != nil {
+		return err
+	}
+	if err = moved.saveAccount(user); err != nil {
+		return err
+	}
+
+	for _, ext := range []string{".json", ".key"} {
+		if err = at.AccountStorage.Delete(context.TODO(), at.accountFileName(at.Config.Email, ext)); err != nil {
+			return err
+		}
+	}
+	at.Config.Email = email
+	return nil
+}
+
+// RotateAccountKey replaces account key with a new one of Config.AccountKeyType
+// (RFC 8555 key rollover). New key is kept under .next.key until the CA confirms it.
+func (at *AutoTls) RotateAccountKey() error {
+	user, err := at.registeredUser()
+	if err != nil {
+		return err
+	}
+
+	newKey, err := certcrypto.GeneratePrivateKey(at.accountKeyType())
+	if err != nil {
+		return err
+	}
+	b := pem.EncodeToMemory(certcrypto.PEMBlock(newKey))
+
+	path := at.accountFileName(at.Config.Email, ".key")
+	next := at.accountFileName(at.Config.Email, ".next.key")
+	if err = at.AccountStorage.Write(context.TODO(), next, b); err != nil {
+		return err
+	}
+	if err = at.keyChange(user, newKey); err != nil {
+		at.AccountStorage.Delete(context.TODO(), next)
+		return err
+	}
+	if err = at.AccountStorage.Write(context.TODO(), path, b); err != nil {
+		return fmt.Errorf("Key was rotated but could not be stored, new key is kept in %s: %w", next, err)
+	}
+	return at.AccountStorage.Delete(context.TODO(), next)
+}
+
+const tlsAcmeAccountDoesNotExist = "urn:ietf:params:acme:error:accountDoesNotExist"
+
+// promoteNextKey finishes key rollover interrupted before the new key was stored.
+// Key staged under .next.key replaces account key when the CA resolves it
+// to the account, it is removed when the CA does not know it.
+func (at *AutoTls) promoteNextKey(user *AcmeUser) error {
+	next := at.accountFileName(at.Config.Email, ".next.key")
+	exists, err := at.AccountStorage.Exists(context.TODO(), next)
+	if err != nil || !exists || user.Registration == nil {
+		return err
+	}
+
+	b, err := at.AccountStorage.Read(context.TODO(), next)
+	if err != nil {
+		return err
+	}
+	key, err := parsePrivateKey(b)
+	if err != nil {
+		return fmt.Errorf("Could not load pending account key %s: %w", next, err)
+	}
+
+	reg, err := at.tryRecoverRegistration(key)
+	var problem *acme.ProblemDetails
+	switch {
+	case errors.As(err, &problem) && problem.Type == tlsAcmeAccountDoesNotExist:
+		log.Printf("Key rollover was not confirmed by the CA, removing pending account key %s", next)
+		return at.AccountStorage.Delete(context.TODO(), next)
+	case err != nil:
+		// CA is not reachable, try again next time
+		log.Printf("Could not check pending account key %s: %v", next, err)
+		return nil
+	case reg.URI != user.Registration.URI:
+		return fmt.Errorf("Pending account key %s belongs to another account %s", next, reg.URI)
+	}
+
+	if err = at.AccountStorage.Write(context.TODO(), at.accountFileName(at.Config.Email, ".key"), b); err != nil {
+		return err
+	}
+	user.key = key
+	log.Printf("Key rollover was confirmed by the CA, pending account key %s is now in use", next)
+	return at.AccountStorage.Delete(context.TODO(), next)
+}
+
+// DeactivateAccount deactivates account at the CA, this can't be undone.
+func (at *AutoTls) DeactivateAccount() error {
+	user, err := at.registeredUser()
+	if err != nil {
+		return err
+	}
+	client, err := at.newClient(user, at.keyType())
+	if err != nil {
+		return err
+	}
+	if err = client.Registration.DeleteRegistration(); err != nil {
+		return err
+	}
+	user.Registration.Body.Status = tlsAccountDeactivated
+	return at.saveAccount(user)
+}
+
+func (at *AutoTls) account(user *AcmeUser) *TlsAccount {
+	acc := &TlsAccount{
+		Email:     user.Email,
+		Path:      at.accountFilePath(),
+		Directory: at.caDirUrl(),
+	}
+	if signer, ok := user.key.(crypto.Signer); ok {
+		acc.KeyType = TlsKeyTypeName(tlsPublicKeyType(signer.Public()))
+	}
+	if user.Registration != nil {
+		acc.URI = user.Registration.URI
+		acc.Status = user.Registration.Body.Status
+		acc.Contact = user.Registration.Body.Contact
+	}
+	return acc
+}
+
+// existingUser loads account without creating a key for it.
+func (at *AutoTls) existingUser() (*AcmeUser, error) {
+	if err := at.migrateAccount(); err != nil {
+		return nil, err
+	}
+	exists, err := at.AccountStorage.Exists(context.TODO(), at.accountFileName(at.Config.Email, ".key"))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("Account %s does not exist", at.Config.Email)
+	}
+	return at.loadUser()
+}
+
+func (at *AutoTls) registeredUser() (*AcmeUser, error) {
+	user, err := at.existingUser()
+	if err != nil {
+		return nil, err
+	}
+	if user.Registration == nil {
+		return nil, fmt.Errorf("Account is not registered. Issue new certificate.")
+	}
+	if user.Registration.Body.Status == tlsAccountDeactivated {
+		return nil, fmt.Errorf("Account %s is deactivated", user.Registration.URI)
+	}
+	return user, nil
+}
+
+// migrateAccount moves account stored under older names to hashed paths
+// of the current directory (see accountLegacyStems).
+func (at *AutoTls) migrateAccount() error {
+	stems, err := at.accountLegacyStems()
+	if err != nil {
+		return err
+	}
+	for _, stem := range stems {
+		for _, ext := range []string{".key", ".json"} {
+			legacy := stem + ext
+			hashed := at.accountFileName(at.Config.Email, ext)
+
+			exists, err := at.AccountStorage.Exists(context.TODO(), legacy)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			exists, err = at.AccountStorage.Exists(context.TODO(), hashed)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				b, err := at.AccountStorage.Read(context.TODO(), legacy)
+				if err != nil {
+					return err
+				}
+				if err = at.AccountStorage.Write(context.TODO(), hashed, b); err != nil {
+					return err
+				}
+			}
+			if err = at.AccountStorage.Delete(context.TODO(), legacy); err != nil {
+				return err
+			}
+			log.Printf("Migrated account %s to %s", legacy, hashed)
+		}
+	}
+	return nil
+}
+
+// accountLegacyStems returns paths (without extension) of accounts stored under
+// plain email or hash of email only, registered with the current directory.
+// Accounts registered with other CAs are left in place.
+func (at *AutoTls) accountLegacyStems() ([]string, error) {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(at.Config.Email))))
+	candidates := []string{
+		filepath.Join(at.Config.AccountPathPrefix, at.Config.Email),
+		filepath.Join(at.Config.AccountPathPrefix, hex.EncodeToString(sum[:])),
+	}
+
+	stems := make([]string, 0, len(candidates))
+	for _, stem := range candidates {
+		exists, err := at.AccountStorage.Exists(context.TODO(), stem+".json")
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			b, err := at.AccountStorage.Read(context.TODO(), stem+".json")
+			if err != nil {
+				return nil, err
+			}
+			var user AcmeUser
+			if err = json.Unmarshal(b, &user); err != nil {
+				return nil, fmt.Errorf("Invalid %s.json: %w", stem, err)
+			}
+			if user.Registration != nil && !sameHost(user.Registration.URI, at.acmeDirectory()) {
+				continue
+			}
+		} else if exists, err = at.AccountStorage.Exists(context.TODO(), stem+".key"); err != nil {
+			return nil, err
+		}
+		if exists {
+			stems = append(stems, stem)
+		}
+	}
+	return stems, nil
+}
+
+func sameHost(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Host, ub.Host)
+}
+
+// keyChange performs key rollover (RFC 8555 section 7.3.5), lego has no support for it.
+func (at *AutoTls) keyChange(user *AcmeUser, newKey crypto.PrivateKey) error {
+	config, err := at.legoConfig(user)
+	if err != nil {
+		return err
+	}
+	core, err := api.New(config.HTTPClient, config.UserAgent, config.CADirURL, user.Registration.URI, user.key)
+	if err != nil {
+		return err
+	}
+	dir := core.GetDirectory()
+	if dir.KeyChangeURL == "" {
+		return errors.New("ACME server does not support key rollover")
+	}
+
+	oldSigner, ok := user.key.(crypto.Signer)
+	if !ok {
+		return errors.New("Unsupported account key")
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"account": user.Registration.URI,
+		"oldKey":  jose.JSONWebKey{Key: oldSigner.Public()},
+	})
+	if err != nil {
+		return err
+	}
+
+	inner, err := signJws(newKey, "", dir.KeyChangeURL, payload, nil)
+	if err != nil {
+		return err
+	}
+	nonces := &acmeNonceSource{client: config.HTTPClient, url: dir.NewNonceURL, userAgent: config.UserAgent}
+	outer, err := signJws(user.key, user.Registration.URI, dir.KeyChangeURL, []byte(inner.FullSerialize()), nonces)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, dir.KeyChangeURL, bytes.NewBufferString(outer.FullSerialize()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	req.Header.Set("User-Agent", config.UserAgent)
+	res, err := config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Key rollover failed: %s %s", res.Status, body)
+	}
+	return nil
+}
+
+// signJws signs payload with key, embedding public key when kid is empty.
+func signJws(key crypto.PrivateKey, kid, url string, payload []byte, nonces jose.NonceSource) (*jose.JSONWebSignature, error) {
+	var alg jose.SignatureAlgorithm
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			alg = jose.ES256
+		case elliptic.P384():
+			alg = jose.ES384
+		case elliptic.P521():
+			alg = jose.ES512
+		}
+	case ed25519.PrivateKey:
+		alg = jose.EdDSA
+	}
+	if alg == "" {
+		return nil, errors.New("Unsupported account key")
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: key, KeyID: kid},
+	}, &jose.SignerOptions{
+		NonceSource:  nonces,
+		EmbedJWK:     kid == "",
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"url": url},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(payload)
+}
+
+type acmeNonceSource struct {
+	client    *http.Client
+	url       string
+	userAgent string
+}
+
+func (n *acmeNonceSource) Nonce() (string, error) {
+	req, err := http.NewRequest(http.MethodHead, n.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", n.userAgent)
+	res, err := n.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("ACME server did not return nonce")
+	}
+	return nonce, nil
+}
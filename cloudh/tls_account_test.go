@@ -0,0 +1,372 @@
+package cloudh
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/registration"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+type testNonceSource struct{}
+
+func (testNonceSource) Nonce() (string, error) { return "nonce", nil }
+
+func TestSignJws(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	p224, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+
+	tests := []struct {
+		name string
+		key  crypto.PrivateKey
+		kid  string
+		alg  jose.SignatureAlgorithm
+		err  bool
+	}{
+		{name: "rsa", key: rsaKey, alg: jose.RS256},
+		{name: "p256", key: p256, alg: jose.ES256},
+		{name: "p384", key: p384, kid: "https://ca/acct/1", alg: jose.ES384},
+		{name: "p521", key: p521, alg: jose.ES512},
+		{name: "ed25519", key: edKey, alg: jose.EdDSA},
+		{name: "unsupported curve", key: p224, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jws, err := signJws(tt.key, tt.kid, "https://ca/key-change", []byte(`{}`), testNonceSource{})
+			if tt.err {
+				if err == nil {
+					t.Fatal("signJws() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := jose.ParseSigned(jws.FullSerialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := parsed.Signatures[0].Protected
+			if header.Algorithm != string(tt.alg) {
+				t.Errorf("alg = %s, want %s", header.Algorithm, tt.alg)
+			}
+			if header.KeyID != tt.kid {
+				t.Errorf("kid = %q, want %q", header.KeyID, tt.kid)
+			}
+			if (header.JSONWebKey != nil) != (tt.kid == "") {
+				t.Errorf("jwk embedded = %v, want %v", header.JSONWebKey != nil, tt.kid == "")
+			}
+			if header.Nonce != "nonce" || header.ExtraHeaders["url"] != "https://ca/key-change" {
+				t.Errorf("unexpected protected header %+v", header)
+			}
+			if _, err = parsed.Verify(tt.key.(crypto.Signer).Public()); err != nil {
+				t.Errorf("Verify() = %v", err)
+			}
+		})
+	}
+}
+
+func TestRotateAccountKey(t *testing.T) {
+	var at *AutoTls
+	var newPublic crypto.PublicKey
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(acme.Directory{
+			NewNonceURL:   srv.URL + "/nonce",
+			NewAccountURL: srv.URL + "/acct",
+			NewOrderURL:   srv.URL + "/order",
+			RevokeCertURL: srv.URL + "/revoke",
+			KeyChangeURL:  srv.URL + "/key-change",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/key-change", func(w http.ResponseWriter, r *http.Request) {
+		fail := func(format string, args ...interface{}) {
+			t.Errorf(format, args...)
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+
+		// new key is staged as a key file until the CA confirms it
+		fi, err := os.Stat(at.accountFileName(at.Config.Email, ".next.key"))
+		if err != nil {
+			fail("staged key: %v", err)
+			return
+		}
+		if fi.Mode().Perm() != 0o600 {
+			fail("staged key mode = %o, want 600", fi.Mode().Perm())
+		}
+
+		oldKey, err := at.accountPrivateKey()
+		if err != nil {
+			fail("%v", err)
+			return
+		}
+		oldPublic := oldKey.(crypto.Signer).Public()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		outer, err := jose.ParseSigned(string(body))
+		if err != nil {
+			fail("outer: %v", err)
+			return
+		}
+		if kid := outer.Signatures[0].Protected.KeyID; kid != srv.URL+"/acct/1" {
+			fail("outer kid = %q", kid)
+		}
+		innerBody, err := outer.Verify(oldPublic)
+		if err != nil {
+			fail("outer signature: %v", err)
+			return
+		}
+
+		inner, err := jose.ParseSigned(string(innerBody))
+		if err != nil {
+			fail("inner: %v", err)
+			return
+		}
+		jwk := inner.Signatures[0].Protected.JSONWebKey
+		if jwk == nil {
+			fail("inner jwk = %+v", jwk)
+			return
+		}
+		payload, err := inner.Verify(jwk.Key)
+		if err != nil {
+			fail("inner signature: %v", err)
+			return
+		}
+		newPublic = jwk.Key
+
+		var change struct {
+			Account string          `json:"account"`
+			OldKey  jose.JSONWebKey `json:"oldKey"`
+		}
+		if err = json.Unmarshal(payload, &change); err != nil {
+			fail("payload: %v", err)
+			return
+		}
+		if change.Account != srv.URL+"/acct/1" {
+			fail("account = %q", change.Account)
+		}
+		if !reflect.DeepEqual(change.OldKey.Key, oldPublic) {
+			fail("oldKey = %+v", change.OldKey.Key)
+		}
+	})
+
+	at = &AutoTls{
+		Config: TlsConfig{
+			Email:             "ops@example.com",
+			AccountPathPrefix: t.TempDir(),
+			AcmeDirectory:     srv.URL + "/dir",
+			AccountKeyType:    certcrypto.EC384,
+		},
+		AccountStorage: &TlsFileStorage{},
+	}
+	key, err := at.accountPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &registration.Resource{URI: srv.URL + "/acct/1", Body: acme.Account{Status: "valid"}}
+	if err = at.saveAccount(&AcmeUser{Email: at.Config.Email, Registration: reg, key: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = at.RotateAccountKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := at.accountPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rotated.(crypto.Signer).Public(), newPublic) {
+		t.Error("stored key differs from the key sent to the CA")
+	}
+	if _, err = os.Stat(at.accountFileName(at.Config.Email, ".next.key")); !os.IsNotExist(err) {
+		t.Errorf("staged key was not removed: %v", err)
+	}
+}
+
+func TestMigrateAccount(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		migrated bool
+	}{
+		{name: "same directory", uri: "https://acme-v02.api.letsencrypt.org/acme/acct/1", migrated: true},
+		{name: "not registered", migrated: true},
+		{name: "other directory", uri: "https://acme.zerossl.com/v2/DV90/account/1", migrated: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := &AutoTls{
+				Config:         TlsConfig{Email: "ops@example.com", AccountPathPrefix: t.TempDir()},
+				AccountStorage: &TlsFileStorage{},
+			}
+			stems, err := at.accountLegacyStems()
+			if err != nil || len(stems) != 0 {
+				t.Fatalf("accountLegacyStems() = %v, %v", stems, err)
+			}
+
+			// email-only hash used before directory was part of the name
+			sum := sha256.Sum256([]byte(at.Config.Email))
+			legacy := filepath.Join(at.Config.AccountPathPrefix, hex.EncodeToString(sum[:]))
+			user := AcmeUser{Email: at.Config.Email}
+			if tt.uri != "" {
+				user.Registration = &registration.Resource{URI: tt.uri}
+			}
+			b, _ := json.Marshal(user)
+			ioutil.WriteFile(legacy+".json", b, 0o600)
+			ioutil.WriteFile(legacy+".key", []byte("key"), 0o600)
+
+			if err = at.migrateAccount(); err != nil {
+				t.Fatal(err)
+			}
+			_, err = os.Stat(at.accountFileName(at.Config.Email, ".key"))
+			if migrated := err == nil; migrated != tt.migrated {
+				t.Errorf("migrated = %v, want %v", migrated, tt.migrated)
+			}
+			if _, err = os.Stat(legacy + ".json"); os.IsNotExist(err) != tt.migrated {
+				t.Errorf("legacy account kept = %v, want %v", !os.IsNotExist(err), !tt.migrated)
+			}
+		})
+	}
+}
+
+func TestAccountFileName(t *testing.T) {
+	le := &AutoTls{Config: TlsConfig{AccountPathPrefix: "acc"}}
+	staging := &AutoTls{Config: TlsConfig{AccountPathPrefix: "acc", Debug: true}}
+	zerossl := &AutoTls{Config: TlsConfig{AccountPathPrefix: "acc", AcmeDirectory: "https://acme.zerossl.com/v2/DV90"}}
+
+	names := map[string]bool{}
+	for _, at := range []*AutoTls{le, staging, zerossl} {
+		names[at.accountFileName("Ops@Example.com ", ".key")] = true
+	}
+	if len(names) != 3 {
+		t.Errorf("accountFileName() is not unique per directory: %v", names)
+	}
+	if le.accountFileName("Ops@Example.com ", ".key") != le.accountFileName("ops@example.com", ".key") {
+		t.Error("accountFileName() depends on email case")
+	}
+}
+
+func TestLoadUserPromotesNextKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		account  string // account the CA resolves staged key to
+		status   int
+		promoted bool
+		kept     bool
+		err      bool
+	}{
+		{name: "confirmed", account: "/acct/1", promoted: true},
+		{name: "not confirmed", status: http.StatusBadRequest},
+		{name: "CA unavailable", status: http.StatusServiceUnavailable, kept: true},
+		{name: "other account", account: "/acct/2", kept: true, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(acme.Directory{
+					NewNonceURL:   srv.URL + "/nonce",
+					NewAccountURL: srv.URL + "/acct",
+					NewOrderURL:   srv.URL + "/order",
+					RevokeCertURL: srv.URL + "/revoke",
+				})
+			})
+			mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Replay-Nonce", "nonce")
+			})
+			mux.HandleFunc("/acct", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Replay-Nonce", "nonce")
+				switch tt.status {
+				case http.StatusBadRequest:
+					w.Header().Set("Content-Type", "application/problem+json")
+					w.WriteHeader(tt.status)
+					json.NewEncoder(w).Encode(acme.ProblemDetails{Type: tlsAcmeAccountDoesNotExist, HTTPStatus: tt.status})
+				case http.StatusServiceUnavailable:
+					w.WriteHeader(tt.status)
+				default:
+					w.Header().Set("Location", srv.URL+tt.account)
+					json.NewEncoder(w).Encode(acme.Account{Status: "valid"})
+				}
+			})
+
+			at := &AutoTls{
+				Config: TlsConfig{
+					Email:             "ops@example.com",
+					AccountPathPrefix: t.TempDir(),
+					AcmeDirectory:     srv.URL + "/dir",
+				},
+				AccountStorage: &TlsFileStorage{},
+			}
+			key, err := at.accountPrivateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg := &registration.Resource{URI: srv.URL + "/acct/1", Body: acme.Account{Status: "valid"}}
+			if err = at.saveAccount(&AcmeUser{Email: at.Config.Email, Registration: reg, key: key}); err != nil {
+				t.Fatal(err)
+			}
+			nextKey, err := certcrypto.GeneratePrivateKey(certcrypto.EC256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := at.accountFileName(at.Config.Email, ".next.key")
+			if err = ioutil.WriteFile(next, pem.EncodeToMemory(certcrypto.PEMBlock(nextKey)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := at.loadUser()
+			if (err != nil) != tt.err {
+				t.Fatalf("loadUser() = %v, want error %v", err, tt.err)
+			}
+			stored, err := at.accountPrivateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := key
+			if tt.promoted {
+				want = nextKey
+			}
+			if !reflect.DeepEqual(stored.(crypto.Signer).Public(), want.(crypto.Signer).Public()) {
+				t.Errorf("stored key promoted = %v, want %v", !tt.promoted, tt.promoted)
+			}
+			if user != nil && !reflect.DeepEqual(user.key.(crypto.Signer).Public(), want.(crypto.Signer).Public()) {
+				t.Error("loaded user key differs from stored key")
+			}
+			if _, err = os.Stat(next); os.IsNotExist(err) == tt.kept {
+				t.Errorf("staged key kept = %v, want %v", !tt.kept, tt.kept)
+			}
+		})
+	}
+}
@@ -3,128 +3,332 @@ package cloudh
 import (
 	"context"
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/lego"
-	"github.com/go-acme/lego/v4/providers/dns/hetzner"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/qbart/ohowl/owl"
-	"github.com/qbart/ohowl/tea"
 	"golang.org/x/net/idna"
 )
 
+// archived (revoked) files are stored as <name><ext><suffix><unix time>
+const tlsArchiveSuffix = ".revoked-"
+
 // Issue requests new cert.
-func (at *AutoTls) Issue() error {
-	user, client, err := at.setup()
+func (at *AutoTls) Issue() (err error) {
+	defer func(start time.Time) { tlsObserve("issue", start, err) }(time.Now())
+
+	issuer, err := at.issuer(true)
 	if err != nil {
 		return err
 	}
-	if user.Registration == nil {
-		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
-		if err != nil {
-			return err
-		}
-		user.Registration = reg
 
-		if err = at.saveAccount(user); err != nil {
-			return err
-		}
+	if len(at.Config.Domains) == 0 {
+		return errors.New("Domain is not specified")
 	}
 
-	request := certificate.ObtainRequest{
-		Domains:        at.Config.Domains,
-		Bundle:         true,
-		MustStaple:     false,
-		PreferredChain: "",
-	}
-	certificates, err := client.Certificate.Obtain(request)
+	_, err = at.withLock(at.Config.Domains[0], func() error {
+		return at.obtain(issuer, at.Config.Domains, nil, at.keyType())
+	})
+	return err
+}
+
+func (at *AutoTls) Renew(reuseKey bool) error {
+	_, err := at.renew(reuseKey)
+	return err
+}
+
+// renew reports whether the certificate was actually renewed.
+func (at *AutoTls) renew(reuseKey bool) (bool, error) {
+	issuer, err := at.issuer(false)
 	if err != nil {
-		return err
+		tlsObserve("renew", time.Now(), err)
+		return false, err
 	}
+	return at.renewWith(issuer, reuseKey)
+}
+
+// renewWith renews using issuer set up by the caller (shared by RenewAll workers).
+func (at *AutoTls) renewWith(issuer TlsIssuer, reuseKey bool) (renewed bool, err error) {
+	defer func(start time.Time) { tlsObserve("renew", start, err) }(time.Now())
+
+	if len(at.Config.Domains) == 0 {
+		return false, errors.New("Domain is not specified")
+	}
+	domain := at.Config.Domains[0]
 
-	return at.saveResource(certificates)
+	_, err = at.withLock(domain, func() (err error) {
+		renewed, err = at.renewLocked(issuer, domain, reuseKey)
+		return err
+	})
+	return renewed, err
 }
 
-func (at *AutoTls) Renew(reuseKey bool) error {
-	user, client, err := at.setup()
+func (at *AutoTls) renewLocked(issuer TlsIssuer, domain string, reuseKey bool) (bool, error) {
+	d, err := at.renewDecision(domain)
 	if err != nil {
-		return err
+		return false, err
 	}
-	if user.Registration == nil {
-		return fmt.Errorf("Account is not registered. Issue new certificate.")
+	if !d.renew {
+		log.Printf("[%s] No renewal, certificate %s", domain, d.reason)
+		return false, at.retryDeploy(domain)
 	}
 
-	if len(at.Config.Domains) == 0 {
-		return errors.New("Domain is not specified")
+	log.Printf("[%s] Trying renewal, certificate %s", domain, d.reason)
+	if d.csr != nil {
+		return true, at.obtainCsr(issuer, d.csr)
 	}
-	domain := at.Config.Domains[0]
 
+	var privateKey crypto.PrivateKey
+	if reuseKey && !d.convert {
+		keyBytes, err := at.Storage.Read(context.TODO(), at.getCertFileName(domain, ".key"))
+		if err != nil {
+			return false, fmt.Errorf("Error while loading the private key for domain %s\n\t%w", domain, err)
+		}
+
+		privateKey, err = certcrypto.ParsePEMPrivateKey(keyBytes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, at.obtain(issuer, d.domains, privateKey, d.keyType)
+}
+
+// tlsRenewDecision is what renewal of stored certificate does,
+// shared by Renew, RenewAll and PlanRenew.
+type tlsRenewDecision struct {
+	cert    *x509.Certificate
+	csr     *x509.CertificateRequest // re-submitted instead of ordering with own key
+	domains []string
+	keyType certcrypto.KeyType
+	convert bool // key type changes
+	renew   bool
+	// deployPending is set when previous deploy failed, it is retried
+	// when certificate is not renewed
+	deployPending bool
+	reason        string
+}
+
+// renewDecision decides renewal of stored certificate of domain from storage only.
+func (at *AutoTls) renewDecision(domain string) (*tlsRenewDecision, error) {
 	certificates, err := at.readCertificate(domain, ".crt")
 	if err != nil {
-		return fmt.Errorf("Error while loading the certificate for domain %s\n\t%w", domain, err)
+		return nil, fmt.Errorf("Error while loading the certificate for domain %s\n\t%w", domain, err)
 	}
-
 	cert := certificates[0]
 	if cert.IsCA {
-		return fmt.Errorf("[%s] Certificate bundle starts with a CA certificate", domain)
+		return nil, fmt.Errorf("[%s] Certificate bundle starts with a CA certificate", domain)
 	}
 
-	if !at.needsRenewal(cert, domain, 30) {
-		return nil
+	var meta TlsCertMeta
+	if _, err = at.readJson(at.getCertFileName(domain, ".json"), &meta); err != nil {
+		return nil, err
 	}
 
-	timeLeft := cert.NotAfter.Sub(time.Now().UTC())
-	log.Printf("[%s] acme: Trying renewal with %d hours remaining", domain, int(timeLeft.Hours()))
+	days, left := at.renewDays(), int(time.Until(cert.NotAfter).Hours()/24.0)
+	d := &tlsRenewDecision{
+		cert:          cert,
+		domains:       certDomains(cert),
+		renew:         days < 0 || left <= days,
+		deployPending: meta.DeployError != "",
+		reason:        fmt.Sprintf("expires in %d days (renew within %d days)", left, days),
+	}
 
-	// technically passed domains might be different than cert domains
-	// so it should be merged like lego lib does it but for Owl purpose
-	// this behavior is not needed
-	// certDomains := certcrypto.ExtractDomains(cert)
+	if d.csr, err = at.readCsr(domain); err != nil {
+		return nil, err
+	}
+	if d.csr != nil {
+		if !equalDomains(at.Config.Domains, csrDomains(d.csr)) {
+			return nil, fmt.Errorf("[%s] Requested domains differ from stored CSR (%s), issue certificate with a new CSR",
+				domain, strings.Join(csrDomains(d.csr), ", "))
+		}
+		return d, nil
+	}
 
-	var privateKey crypto.PrivateKey
-	if reuseKey {
-		keyBytes, err := at.Storage.Read(context.TODO(), at.getCertFileName(domain, ".key"))
-		if err != nil {
-			return fmt.Errorf("Error while loading the private key for domain %s\n\t%w", domain, err)
+	domains, reissue, err := at.renewDomains(domain, d.domains)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep key type of the certificate unless configured explicitly
+	d.keyType = at.keyType()
+	if at.Config.KeyType == "" {
+		d.keyType = tlsPublicKeyType(cert.PublicKey)
+	}
+	d.convert = at.keyTypeChanged(cert.PublicKey)
+
+	switch {
+	case d.convert:
+		d.renew = true
+		d.reason = fmt.Sprintf("key type changes from %s to %s", TlsKeyTypeName(tlsPublicKeyType(cert.PublicKey)), TlsKeyTypeName(d.keyType))
+	case reissue:
+		d.renew = true
+		changes := make([]string, 0, 2)
+		if added := diffDomains(domains, d.domains); len(added) > 0 {
+			changes = append(changes, "added: "+strings.Join(added, ", "))
 		}
+		if removed := diffDomains(d.domains, domains); len(removed) > 0 {
+			changes = append(changes, "removed: "+strings.Join(removed, ", "))
+		}
+		d.reason = fmt.Sprintf("SANs change (%s)", strings.Join(changes, "; "))
+	}
+	d.domains = domains
+	return d, nil
+}
 
-		privateKey, err = certcrypto.ParsePEMPrivateKey(keyBytes)
-		if err != nil {
-			return err
+// renewDomains compares requested domains with certificate SANs and returns
+// domains to order according to Config.DomainsChanged policy and whether
+// certificate has to be reissued right away (regardless of expiry).
+func (at *AutoTls) renewDomains(domain string, certDomains []string) ([]string, bool, error) {
+	requested := at.Config.Domains
+	if equalDomains(requested, certDomains) {
+		return certDomains, false, nil
+	}
+
+	added := diffDomains(requested, certDomains)
+	removed := diffDomains(certDomains, requested)
+
+	switch at.Config.DomainsChanged {
+	case TlsDomainsMerge:
+		merged := append(append([]string{}, requested...), removed...)
+		return merged, len(added) > 0, nil
+
+	case TlsDomainsReplace:
+		return requested, true, nil
+	}
+
+	return nil, false, fmt.Errorf("[%s] Requested domains differ from certificate (added: %s, removed: %s), use domains-changed=merge|replace",
+		domain, strings.Join(added, ", "), strings.Join(removed, ", "))
+}
+
+// RenewAll walks every stored certificate and renews the ones expiring
+// within Config.RenewDays, running at most parallel renewals at once.
+// Config.Domains is ignored, SANs are taken from the certificates.
+func (at *AutoTls) RenewAll(parallel int) ([]TlsRenewResult, error) {
+	certs, err := at.List()
+	if err != nil {
+		return nil, err
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	// account is set up once, parallel setups would race on creating it
+	var issuer TlsIssuer
+
+	results := make([]TlsRenewResult, len(certs))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	for i, cert := range certs {
+		domains := cert.Domains()
+		if cert.Meta != nil && len(cert.Meta.Domains) > 0 {
+			domains = cert.Meta.Domains
 		}
-	} else {
-		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		if err != nil {
-			return err
+		results[i].Domain = strings.Join(domains, ",")
+
+		if len(domains) == 0 {
+			results[i].Err = fmt.Errorf("Certificate %s has no domains", cert.Path)
+			continue
+		}
+		job := *at
+		job.Config.Domains = domains
+		// errors are reported (and observed) by renewWith
+		if d, err := job.renewDecision(domains[0]); err == nil && !d.renew && !d.deployPending {
+			continue
 		}
+
+		if issuer == nil {
+			if issuer, err = at.issuer(false); err != nil {
+				return nil, err
+			}
+		}
+
+		wg.Add(1)
+		go func(i int, job AutoTls) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i].Renewed, results[i].Err = job.renewWith(issuer, false)
+		}(i, job)
 	}
+	wg.Wait()
 
-	request := certificate.ObtainRequest{
-		Domains:        at.Config.Domains,
-		Bundle:         true,
-		PrivateKey:     privateKey,
-		MustStaple:     false,
-		PreferredChain: "",
+	return results, nil
+}
+
+// Revoke revokes the stored certificate for domain at the CA and removes
+// (or archives when Config.ArchiveRevoked is set) its key/crt/ca files.
+// It fails when the certificate is being ordered by another process.
+func (at *AutoTls) Revoke(domain string, reason uint) error {
+	locked, err := at.withLock(domain, func() error {
+		return at.revoke(domain, reason)
+	})
+	if err == nil && !locked {
+		return fmt.Errorf("[%s] %w", domain, ErrTlsLocked)
+	}
+	return err
+}
+
+func (at *AutoTls) revoke(domain string, reason uint) error {
+	user, err := at.loadUser()
+	if err != nil {
+		return err
+	}
+	if user.Registration == nil {
+		return fmt.Errorf("Account is not registered. Nothing to revoke.")
 	}
-	certRes, err := client.Certificate.Obtain(request)
+
+	certificates, err := at.readCertificate(domain, ".crt")
+	if err != nil {
+		return fmt.Errorf("Error while loading the certificate for domain %s\n\t%w", domain, err)
+	}
+
+	cert := certificates[0]
+	if cert.IsCA {
+		return fmt.Errorf("[%s] Certificate bundle starts with a CA certificate", domain)
+	}
+
+	config, err := at.legoConfig(user)
+	if err != nil {
+		return err
+	}
+	core, err := api.New(config.HTTPClient, config.UserAgent, config.CADirURL, user.Registration.URI, user.key)
+	if err != nil {
+		return fmt.Errorf("Could not create client: %w", err)
+	}
+
+	err = core.Certificates.Revoke(acme.RevokeCertMessage{
+		Certificate: base64.RawURLEncoding.EncodeToString(cert.Raw),
+		Reason:      &reason,
+	})
 	if err != nil {
 		return err
 	}
+	log.Printf("[%s] acme: Certificate revoked (reason: %d)", domain, reason)
 
-	return at.saveResource(certRes)
+	return at.deleteResource(domain)
 }
 
 func (at *AutoTls) List() ([]TlsCert, error) {
@@ -135,76 +339,207 @@ func (at *AutoTls) List() ([]TlsCert, error) {
 
 	certs := make([]TlsCert, 0)
 	for _, filename := range matches {
-		data, err := at.Storage.Read(context.TODO(), filename)
-		if err != nil {
-			return certs, err
-		}
-		cert, err := certcrypto.ParsePEMCertificate(data)
+		cert, err := at.readCert(filename)
 		if err != nil {
 			return certs, err
 		}
-		certs = append(certs, TlsCert{
-			CommonName: cert.Subject.CommonName,
-			DNS:        cert.DNSNames,
-			Expiry:     cert.NotAfter,
-			Path:       filename,
-		})
+		certs = append(certs, *cert)
 	}
 	return certs, nil
 }
 
-func (at *AutoTls) saveResource(res *certificate.Resource) error {
-	return tea.ErrCoalesce(
-		at.Storage.Write(context.TODO(), at.getCertFileName(res.Domain, ".key"), res.PrivateKey),
-		at.Storage.Write(context.TODO(), at.getCertFileName(res.Domain, ".crt"), res.Certificate),
-		at.Storage.Write(context.TODO(), at.getCertFileName(res.Domain, ".ca"), res.IssuerCertificate),
-	)
+// Show returns certificate of domain with its metadata and pending order (if any).
+func (at *AutoTls) Show(domain string) (*TlsCert, error) {
+	cert, err := at.readCert(at.getCertFileName(domain, ".crt"))
+	if err != nil {
+		return nil, err
+	}
+	if err = at.checkKey(cert); err != nil {
+		return nil, err
+	}
+	if cert.Order, err = at.ReadOrder(domain); err != nil {
+		return nil, err
+	}
+	return cert, nil
 }
 
-func (at *AutoTls) readCertificate(domain, ext string) ([]*x509.Certificate, error) {
-	content, err := at.Storage.Read(context.TODO(), at.getCertFileName(domain, ext))
+func (at *AutoTls) readCert(filename string) (*TlsCert, error) {
+	data, err := at.Storage.Read(context.TODO(), filename)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := certcrypto.ParsePEMCertificate(data)
 	if err != nil {
 		return nil, err
 	}
 
-	return certcrypto.ParsePEMBundle(content)
+	var meta TlsCertMeta
+	ok, err := at.readJson(strings.TrimSuffix(filename, ".crt")+".json", &meta)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TlsCert{
+		CommonName: cert.Subject.CommonName,
+		DNS:        cert.DNSNames,
+		Expiry:     cert.NotAfter,
+		DaysLeft:   int(time.Until(cert.NotAfter).Hours() / 24),
+		Path:       filename,
+		KeyType:    TlsKeyTypeName(tlsPublicKeyType(cert.PublicKey)),
+		Issuer:     cert.Issuer.CommonName,
+		Serial:     cert.SerialNumber.Text(16),
+	}
+	if ok {
+		res.Meta = &meta
+	}
+	if res.Csr, err = at.Storage.Exists(context.TODO(), strings.TrimSuffix(filename, ".crt")+".csr"); err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
-func (at *AutoTls) getCertFileName(domain, ext string) string {
-	safe, err := idna.ToASCII(strings.Replace(fmt.Sprint(domain, ext), "*", "_", -1))
+// CheckKeys sets KeyMatch of listed certificates. It reads (and decrypts) every
+// private key, so List leaves it to callers that need it.
+func (at *AutoTls) CheckKeys(certs []TlsCert) error {
+	for i := range certs {
+		if err := at.checkKey(&certs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (at *AutoTls) checkKey(cert *TlsCert) error {
+	data, err := at.Storage.Read(context.TODO(), cert.Path)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	return filepath.Join(at.Config.CertPathPrefix, safe)
+	match, err := at.keyMatches(strings.TrimSuffix(cert.Path, ".crt")+".key", data)
+	if err != nil {
+		return err
+	}
+	cert.KeyMatch = &match
+	return nil
 }
 
-func (at *AutoTls) setupDnsChallenge(client *lego.Client) error {
-	hc := hetzner.NewDefaultConfig()
-	hc.APIKey = at.Config.DnsToken
-	provider, err := hetzner.NewDNSProviderConfig(hc)
+// keyMatches reports whether stored key pairs with certificate (false when key is missing).
+func (at *AutoTls) keyMatches(keyFile string, crtPem []byte) (bool, error) {
+	ok, err := at.Storage.Exists(context.TODO(), keyFile)
+	if err != nil || !ok {
+		return false, err
+	}
+	keyPem, err := at.Storage.Read(context.TODO(), keyFile)
+	if err != nil {
+		return false, err
+	}
+	_, err = tls.X509KeyPair(crtPem, keyPem)
+	return err == nil, nil
+}
+
+// saveResource writes key/crt/ca at once when storage supports bundles,
+// otherwise one by one.
+func (at *AutoTls) saveResource(res *certificate.Resource, issuer TlsIssuer) error {
+	meta, err := at.certMeta(res, issuer)
 	if err != nil {
 		return err
 	}
+	// nil removes CSR left by a previous certificate, otherwise Renew
+	// would re-submit it and delete the new key
+	files := map[string][]byte{
+		".key":  res.PrivateKey,
+		".crt":  res.Certificate,
+		".ca":   nil,
+		".csr":  nil,
+		".json": meta,
+	}
+	if len(res.IssuerCertificate) > 0 {
+		files[".ca"] = res.IssuerCertificate
+	}
+	return at.saveFiles(res.Domain, files)
+}
+
+// saveFiles stores files of domain together, files mapped to nil are removed.
+func (at *AutoTls) saveFiles(domain string, files map[string][]byte) error {
+	if bs, ok := at.Storage.(TlsBundleStorage); ok {
+		return bs.WriteBundle(context.TODO(), at.getCertFileName(domain, ""), files)
+	}
 
-	client.Challenge.SetDNS01Provider(provider)
+	for _, ext := range []string{".json", ".csr", ".ca", ".crt", ".key"} {
+		b, ok := files[ext]
+		if !ok {
+			continue
+		}
+		if b == nil {
+			if err := at.Storage.Delete(context.TODO(), at.getCertFileName(domain, ext)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := at.Storage.Write(context.TODO(), at.getCertFileName(domain, ext), b); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (at *AutoTls) needsRenewal(x509Cert *x509.Certificate, domain string, days int) bool {
-	if days >= 0 {
-		notAfter := int(time.Until(x509Cert.NotAfter).Hours() / 24.0)
-		if notAfter > days {
-			log.Printf("[%s] The certificate expires in %d days, the number of days defined to perform the renewal is %d: no renewal.", domain, notAfter, days)
-			return false
+func (at *AutoTls) deleteResource(domain string) error {
+	suffix := fmt.Sprint(tlsArchiveSuffix, time.Now().UTC().Unix())
+
+	for _, ext := range []string{".key", ".crt", ".ca", ".csr", ".json", ".order"} {
+		key := at.getCertFileName(domain, ext)
+
+		if at.Config.ArchiveRevoked {
+			exists, err := at.Storage.Exists(context.TODO(), key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				b, err := at.Storage.Read(context.TODO(), key)
+				if err != nil {
+					return err
+				}
+				if err = at.Storage.Write(context.TODO(), key+suffix, b); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := at.Storage.Delete(context.TODO(), key); err != nil {
+			return err
 		}
 	}
-	return true
+	return nil
+}
+
+func (at *AutoTls) readCertificate(domain, ext string) ([]*x509.Certificate, error) {
+	content, err := at.Storage.Read(context.TODO(), at.getCertFileName(domain, ext))
+	if err != nil {
+		return nil, err
+	}
+
+	return certcrypto.ParsePEMBundle(content)
+}
+
+func (at *AutoTls) getCertFileName(domain, ext string) string {
+	safe, err := idna.ToASCII(strings.Replace(fmt.Sprint(domain, ext), "*", "_", -1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return filepath.Join(at.Config.CertPathPrefix, safe)
+}
+
+func (at *AutoTls) renewDays() int {
+	if at.Config.RenewDays == nil {
+		return 30
+	}
+	return *at.Config.RenewDays
 }
 
 func (at *AutoTls) newClient(acc registration.User, keyType certcrypto.KeyType) (*lego.Client, error) {
-	config := lego.NewConfig(acc)
-	config.UserAgent = owl.UserAgent
-	config.CADirURL = at.caDirUrl()
+	config, err := at.legoConfig(acc)
+	if err != nil {
+		return nil, err
+	}
 
 	config.Certificate = lego.CertificateConfig{
 		KeyType: keyType,
@@ -220,25 +555,62 @@ func (at *AutoTls) newClient(acc registration.User, keyType certcrypto.KeyType)
 }
 
 func (at *AutoTls) setup() (*AcmeUser, *lego.Client, error) {
+	user, err := at.loadUser()
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Registration != nil && user.Registration.Body.Status == tlsAccountDeactivated {
+		return nil, nil, fmt.Errorf("Account %s is deactivated", user.Registration.URI)
+	}
+
+	client, err := at.newClient(user, at.keyType())
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = at.setupChallenge(client); err != nil {
+		return nil, nil, err
+	}
+
+	return user, client, nil
+}
+
+func (at *AutoTls) loadUser() (*AcmeUser, error) {
 	privateKey, err := at.accountPrivateKey()
+	if err != nil {
+		return nil, err
+	}
 
 	user := &AcmeUser{Email: at.Config.Email, key: privateKey}
 
-	if exists, err := at.AccountStorage.Exists(context.TODO(), at.accountFilePath()); exists {
+	exists, err := at.AccountStorage.Exists(context.TODO(), at.accountFilePath())
+	if err != nil {
+		return nil, err
+	}
+	if exists {
 		if user, err = at.readAccount(privateKey); err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
+	if err = at.promoteNextKey(user); err != nil {
+		return nil, err
+	}
 
-	client, err := at.newClient(user, certcrypto.EC384)
-	if err != nil {
-		return nil, nil, err
+	return user, nil
+}
+
+// register creates ACME account, using External Account Binding when configured.
+func (at *AutoTls) register(client *lego.Client) (*registration.Resource, error) {
+	if (at.Config.EabKid == "") != (at.Config.EabHmac == "") {
+		return nil, errors.New("External Account Binding requires both eab-kid and eab-hmac")
 	}
-	if err = at.setupDnsChallenge(client); err != nil {
-		return nil, nil, err
+	if at.Config.EabKid != "" {
+		return client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: true,
+			Kid:                  at.Config.EabKid,
+			HmacEncoded:          at.Config.EabHmac,
+		})
 	}
-
-	return user, client, nil
+	return client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
 }
 
 func (at *AutoTls) saveAccount(user *AcmeUser) error {
@@ -251,13 +623,23 @@ func (at *AutoTls) saveAccount(user *AcmeUser) error {
 }
 
 func (at *AutoTls) accountFilePath() string {
-	//TODO: hash email
-	return filepath.Join(at.Config.AccountPathPrefix, at.Config.Email+".json")
+	return at.accountFileName(at.Config.Email, ".json")
+}
+
+// accountFileName hashes email and directory URL, so email doesn't leak into
+// storage key names and accounts of different CAs don't overwrite each other.
+func (at *AutoTls) accountFileName(email, ext string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email)) + "\n" + at.acmeDirectory()))
+	return filepath.Join(at.Config.AccountPathPrefix, hex.EncodeToString(sum[:])+ext)
 }
 
+// accountPrivateKey reads account key (PKCS#1, SEC 1 or PKCS#8 PEM),
+// new key is generated when account has none.
 func (at *AutoTls) accountPrivateKey() (crypto.PrivateKey, error) {
-	//TODO: hash email
-	path := filepath.Join(at.Config.AccountPathPrefix, at.Config.Email+".key")
+	if err := at.migrateAccount(); err != nil {
+		return nil, err
+	}
+	path := at.accountFileName(at.Config.Email, ".key")
 
 	exists, err := at.AccountStorage.Exists(context.TODO(), path)
 	if err != nil {
@@ -265,7 +647,7 @@ func (at *AutoTls) accountPrivateKey() (crypto.PrivateKey, error) {
 	}
 
 	if !exists {
-		privateKey, err := certcrypto.GeneratePrivateKey(certcrypto.EC384)
+		privateKey, err := certcrypto.GeneratePrivateKey(at.accountKeyType())
 		if err != nil {
 			return nil, err
 		}
@@ -273,26 +655,28 @@ func (at *AutoTls) accountPrivateKey() (crypto.PrivateKey, error) {
 		pemKey := certcrypto.PEMBlock(privateKey)
 		b := pem.EncodeToMemory(pemKey)
 
-		err = at.Storage.Write(context.TODO(), path, b)
+		err = at.AccountStorage.Write(context.TODO(), path, b)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	b, err := at.Storage.Read(context.TODO(), path)
+	b, err := at.AccountStorage.Read(context.TODO(), path)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load user private key %w", err)
 	}
-	keyBlock, _ := pem.Decode(b)
+	return parsePrivateKey(b)
+}
 
-	switch keyBlock.Type {
-	case "RSA PRIVATE KEY":
-		return x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-	case "EC PRIVATE KEY":
-		return x509.ParseECPrivateKey(keyBlock.Bytes)
+func parsePrivateKey(b []byte) (crypto.PrivateKey, error) {
+	if block, _ := pem.Decode(b); block == nil {
+		return nil, errors.New("Private key is not PEM encoded")
 	}
-
-	return nil, errors.New("Unknown private key type")
+	key, err := certcrypto.ParsePEMPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown private key type: %w", err)
+	}
+	return key, nil
 }
 
 func (at *AutoTls) readAccount(key crypto.PrivateKey) (*AcmeUser, error) {
@@ -324,9 +708,10 @@ func (at *AutoTls) readAccount(key crypto.PrivateKey) (*AcmeUser, error) {
 }
 
 func (at *AutoTls) tryRecoverRegistration(key crypto.PrivateKey) (*registration.Resource, error) {
-	config := lego.NewConfig(&AcmeUser{key: key})
-	config.UserAgent = owl.UserAgent
-	config.CADirURL = at.caDirUrl()
+	config, err := at.legoConfig(&AcmeUser{key: key})
+	if err != nil {
+		return nil, err
+	}
 
 	client, err := lego.NewClient(config)
 	if err != nil {
@@ -340,11 +725,55 @@ func (at *AutoTls) tryRecoverRegistration(key crypto.PrivateKey) (*registration.
 	return reg, nil
 }
 
+// legoConfig points lego at configured CA directory and trusts
+// Config.CaBundle in addition to system roots.
+func (at *AutoTls) legoConfig(user registration.User) (*lego.Config, error) {
+	config := lego.NewConfig(user)
+	config.UserAgent = owl.UserAgent
+	config.CADirURL = at.caDirUrl()
+
+	if at.Config.CaBundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := ioutil.ReadFile(at.Config.CaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", at.Config.CaBundle)
+		}
+
+		transport, ok := config.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("Unexpected ACME HTTP transport")
+		}
+		transport = transport.Clone()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+		config.HTTPClient.Transport = transport
+	}
+	config.HTTPClient.Transport = &tlsAcmeRoundTripper{next: config.HTTPClient.Transport, ctx: at.ctx()}
+
+	return config, nil
+}
+
 func (at *AutoTls) caDirUrl() string {
-	result := lego.LEDirectoryProduction
-	if at.Config.Debug {
+	if at.Config.AcmeDirectory == "" && at.Config.Debug {
 		log.Println("!!! STAGING MODE !!!")
-		result = lego.LEDirectoryStaging
 	}
-	return result
+	return at.acmeDirectory()
+}
+
+func (at *AutoTls) acmeDirectory() string {
+	switch {
+	case at.Config.AcmeDirectory != "":
+		return at.Config.AcmeDirectory
+	case at.Config.Debug:
+		return lego.LEDirectoryStaging
+	}
+	return lego.LEDirectoryProduction
 }
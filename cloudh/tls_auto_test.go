@@ -0,0 +1,274 @@
+package cloudh
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+func TestRenewDomains(t *testing.T) {
+	cert := []string{"a.com", "b.com"}
+	tests := []struct {
+		name      string
+		requested []string
+		policy    string
+		want      []string
+		reissue   bool
+		err       string
+	}{
+		{name: "unchanged", requested: []string{"a.com", "b.com"}, want: cert},
+		{name: "unchanged in other order", requested: []string{"a.com", "B.com"}, policy: TlsDomainsReplace, want: cert},
+		{name: "added fails", requested: []string{"a.com", "b.com", "c.com"}, err: "added: c.com, removed: "},
+		{name: "removed fails", requested: []string{"a.com"}, policy: TlsDomainsFail, err: "added: , removed: b.com"},
+		{name: "merge added", requested: []string{"a.com", "c.com"}, policy: TlsDomainsMerge, want: []string{"a.com", "c.com", "b.com"}, reissue: true},
+		{name: "merge removed keeps SAN", requested: []string{"a.com"}, policy: TlsDomainsMerge, want: cert},
+		{name: "replace added", requested: []string{"a.com", "b.com", "c.com"}, policy: TlsDomainsReplace, want: []string{"a.com", "b.com", "c.com"}, reissue: true},
+		{name: "replace removed", requested: []string{"a.com"}, policy: TlsDomainsReplace, want: []string{"a.com"}, reissue: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := &AutoTls{Config: TlsConfig{Domains: tt.requested, DomainsChanged: tt.policy}}
+			got, reissue, err := at.renewDomains("a.com", cert)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("renewDomains() = %v, %v, want error %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || reissue != tt.reissue {
+				t.Errorf("renewDomains() = %v, %v, want %v, %v", got, reissue, tt.want, tt.reissue)
+			}
+			// common name stays the domain certificate is stored under
+			if got[0] != "a.com" {
+				t.Errorf("renewDomains() common name = %s, want a.com", got[0])
+			}
+		})
+	}
+}
+
+func TestRenewDecisionDomains(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		policy    string
+		renew     bool
+		domains   []string
+		reason    string
+		err       bool
+	}{
+		{name: "unchanged", requested: []string{"a.com", "b.com"}, domains: []string{"a.com", "b.com"}},
+		{name: "SAN removed", requested: []string{"a.com"}, err: true},
+		{
+			name:      "merge",
+			requested: []string{"a.com", "c.com"},
+			policy:    TlsDomainsMerge,
+			renew:     true,
+			domains:   []string{"a.com", "c.com", "b.com"},
+			reason:    "SANs change (added: c.com)",
+		},
+		{
+			name:      "replace",
+			requested: []string{"a.com", "c.com"},
+			policy:    TlsDomainsReplace,
+			renew:     true,
+			domains:   []string{"a.com", "c.com"},
+			reason:    "SANs change (added: c.com; removed: b.com)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := &AutoTls{
+				Config:  TlsConfig{Domains: tt.requested, DomainsChanged: tt.policy, CertPathPrefix: t.TempDir()},
+				Storage: &TlsFileStorage{},
+			}
+			crt, key := testCertificate(t, "a.com", "b.com")
+			for ext, b := range map[string][]byte{".crt": crt, ".key": key} {
+				if err := at.Storage.Write(context.Background(), at.getCertFileName("a.com", ext), b); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d, err := at.renewDecision("a.com")
+			if tt.err {
+				if err == nil {
+					t.Fatalf("renewDecision() = %+v, want error", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.renew != tt.renew || !reflect.DeepEqual(d.domains, tt.domains) {
+				t.Errorf("renewDecision() renew = %v, domains = %v, want %v, %v", d.renew, d.domains, tt.renew, tt.domains)
+			}
+			if tt.reason != "" && d.reason != tt.reason {
+				t.Errorf("renewDecision() reason = %q, want %q", d.reason, tt.reason)
+			}
+		})
+	}
+}
+
+// testIssuer signs with Vault PKI test CA, failing domains listed in fail,
+// and records the highest number of concurrent Obtain calls.
+type testIssuer struct {
+	*TlsVaultPkiIssuer
+	fail     map[string]bool
+	running  int32
+	parallel int32
+}
+
+func (i *testIssuer) Obtain(domains []string, privateKey crypto.PrivateKey) (*certificate.Resource, error) {
+	n := atomic.AddInt32(&i.running, 1)
+	defer atomic.AddInt32(&i.running, -1)
+	for {
+		max := atomic.LoadInt32(&i.parallel)
+		if n <= max || atomic.CompareAndSwapInt32(&i.parallel, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if i.fail[domains[0]] {
+		return nil, fmt.Errorf("%s rejected", domains[0])
+	}
+	return i.TlsVaultPkiIssuer.Obtain(domains, privateKey)
+}
+
+func TestRenewAll(t *testing.T) {
+	vault := &TlsVaultPkiIssuer{Logical: testVaultPki(t, "pki/sign/web", true), Role: "web"}
+	at := &AutoTls{
+		Config:  TlsConfig{CertPathPrefix: t.TempDir(), SkipPreflight: true},
+		Storage: &TlsFileStorage{},
+		Issuer:  vault,
+	}
+	// test CA certificates expire within an hour and are due
+	due := []string{"a.internal", "b.internal", "c.internal", "d.internal", "e.internal"}
+	for _, domain := range due {
+		at.Config.Domains = []string{domain}
+		if err := at.Issue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testStoreCertificate(t, at, "valid.internal", "")
+
+	issuer := &testIssuer{TlsVaultPkiIssuer: vault, fail: map[string]bool{"c.internal": true}}
+	at.Issuer = issuer
+	at.Config.Domains = nil
+	results, err := at.RenewAll(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string, len(results))
+	for _, res := range results {
+		status := "skipped"
+		switch {
+		case res.Err != nil:
+			status = res.Err.Error()
+		case res.Renewed:
+			status = "renewed"
+		}
+		got[res.Domain] = status
+	}
+	want := map[string]string{
+		"a.internal":     "renewed",
+		"b.internal":     "renewed",
+		"c.internal":     "c.internal rejected",
+		"d.internal":     "renewed",
+		"e.internal":     "renewed",
+		"valid.internal": "skipped",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RenewAll() = %v, want %v", got, want)
+	}
+	if issuer.parallel > 3 {
+		t.Errorf("%d renewals ran at once, want at most 3", issuer.parallel)
+	}
+}
+
+func TestRevokeArchives(t *testing.T) {
+	revoked := 0
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(acme.Directory{
+			NewNonceURL:   srv.URL + "/nonce",
+			NewAccountURL: srv.URL + "/acct",
+			NewOrderURL:   srv.URL + "/order",
+			RevokeCertURL: srv.URL + "/revoke",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		revoked++
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+
+	dir := t.TempDir()
+	at := &AutoTls{
+		Config: TlsConfig{
+			Email:             "ops@example.com",
+			CertPathPrefix:    filepath.Join(dir, "tls"),
+			AccountPathPrefix: filepath.Join(dir, "acc"),
+			AcmeDirectory:     srv.URL + "/dir",
+			ArchiveRevoked:    true,
+		},
+		Storage:        &TlsFileStorage{},
+		AccountStorage: &TlsFileStorage{},
+	}
+	key, err := at.accountPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &registration.Resource{URI: srv.URL + "/acct/1", Body: acme.Account{Status: "valid"}}
+	if err = at.saveAccount(&AcmeUser{Email: at.Config.Email, Registration: reg, key: key}); err != nil {
+		t.Fatal(err)
+	}
+	testStoreCertificate(t, at, "a.com", "")
+
+	// held lock fails revoke unless Config.LockWait is set
+	unlock, err := at.Storage.(TlsLocker).Lock(context.Background(), at.getCertFileName("a.com", ".lock"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = at.Revoke("a.com", 0); !errors.Is(err, ErrTlsLocked) || revoked != 0 {
+		t.Fatalf("Revoke() while locked = %v (%d revoked), want %v", err, revoked, ErrTlsLocked)
+	}
+	unlock()
+
+	if err = at.Revoke("a.com", 0); err != nil {
+		t.Fatal(err)
+	}
+	if revoked != 1 {
+		t.Errorf("revoked %d times, want 1", revoked)
+	}
+	for _, ext := range []string{".crt", ".key", ".json"} {
+		if ok, _ := at.Storage.Exists(context.Background(), at.getCertFileName("a.com", ext)); ok {
+			t.Errorf("%s was not removed", ext)
+		}
+		archived, err := filepath.Glob(at.getCertFileName("a.com", ext) + tlsArchiveSuffix + "*")
+		if err != nil || len(archived) != 1 {
+			t.Errorf("%s archives = %v, %v, want one", ext, archived, err)
+		}
+	}
+}
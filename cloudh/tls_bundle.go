@@ -0,0 +1,199 @@
+package cloudh
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	fileBundleDir     = ".owl-bundles"
+	fileBundleCurrent = "current"
+	vaultBundleSuffix = ".bundle"
+)
+
+// TlsBundleStorage is implemented by storages able to write a set of
+// files sharing the same stem (e.g. .key/.crt/.ca) atomically,
+// readers see either the old or the new set, never a mix of both.
+// Files are still read one by one using "<stem><ext>" keys.
+// Extensions mapped to nil are removed as part of the same switch.
+type TlsBundleStorage interface {
+	WriteBundle(ctx context.Context, stem string, files map[string][]byte) error
+}
+
+// ----- TlsFileStorage -----
+//
+// Bundle files are written into a fresh version directory:
+//
+//   <dir>/.owl-bundles/<name>/<version>/<name><ext>
+//   <dir>/.owl-bundles/<name>/current -> <version>
+//   <dir>/<name><ext> -> .owl-bundles/<name>/current/<name><ext>
+//
+// and switched by renaming the "current" symlink. The version replaced by
+// the switch is kept until the next write, so readers which resolved it
+// just before can still open its files.
+
+func (fs *TlsFileStorage) WriteBundle(ctx context.Context, stem string, files map[string][]byte) error {
+	dir, name := filepath.Split(stem)
+	bundleDir := filepath.Join(dir, fileBundleDir, name)
+	version := fmt.Sprint(time.Now().UTC().UnixNano())
+	versionDir := filepath.Join(bundleDir, version)
+
+	if err := os.MkdirAll(versionDir, 0o755); err != nil {
+		return err
+	}
+	for ext, b := range files {
+		if b == nil {
+			continue
+		}
+		if err := fs.writeAtomic(filepath.Join(versionDir, name+ext), b); err != nil {
+			return err
+		}
+	}
+
+	current := filepath.Join(bundleDir, fileBundleCurrent)
+	previous, _ := os.Readlink(current)
+	if err := symlinkAtomic(version, current); err != nil {
+		return err
+	}
+
+	for ext, b := range files {
+		if b == nil {
+			if err := os.Remove(stem + ext); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		target := filepath.Join(fileBundleDir, name, fileBundleCurrent, name+ext)
+		link := stem + ext
+		if current, err := os.Readlink(link); err == nil && current == target {
+			continue
+		}
+		if err := symlinkAtomic(target, link); err != nil {
+			return err
+		}
+	}
+
+	return pruneBundleVersions(bundleDir, version, previous)
+}
+
+// deleteBundleFile removes key when it is a link into bundle directory
+// together with the file it points to, the bundle is dropped once empty.
+func (fs *TlsFileStorage) deleteBundleFile(key string) (bool, error) {
+	target, err := os.Readlink(key)
+	if err != nil || !strings.HasPrefix(target, fileBundleDir+string(filepath.Separator)) {
+		return false, nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(key)
+	if err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	if err = os.Remove(key); err != nil {
+		return true, err
+	}
+	if resolved == "" {
+		return true, nil
+	}
+	if err = os.Remove(resolved); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+
+	versionDir := filepath.Dir(resolved)
+	if entries, err := ioutil.ReadDir(versionDir); err == nil && len(entries) == 0 {
+		return true, os.RemoveAll(filepath.Dir(versionDir))
+	}
+	return true, nil
+}
+
+func symlinkAtomic(target, link string) error {
+	tmp := fmt.Sprint(link, ".tmp-", os.Getpid())
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// pruneBundleVersions removes version directories of bundle except keep.
+func pruneBundleVersions(bundleDir string, keep ...string) error {
+	entries, err := ioutil.ReadDir(bundleDir)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool, len(keep))
+	for _, k := range keep {
+		kept[k] = true
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() && !kept[e.Name()] {
+			names = append(names, e.Name())
+		}
+	}
+	for _, name := range names {
+		if err := os.RemoveAll(filepath.Join(bundleDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ----- TlsConsulStorage -----
+
+func (fs *TlsConsulStorage) WriteBundle(ctx context.Context, stem string, files map[string][]byte) error {
+	ops := make(consulapi.KVTxnOps, 0, len(files))
+	for ext, b := range files {
+		op := &consulapi.KVTxnOp{Verb: consulapi.KVSet, Key: stem + ext, Value: b}
+		if b == nil {
+			op = &consulapi.KVTxnOp{Verb: consulapi.KVDelete, Key: stem + ext}
+		}
+		ops = append(ops, op)
+	}
+
+	ok, resp, _, err := fs.KV.Txn(ops, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		errs := make([]string, 0, len(resp.Errors))
+		for _, e := range resp.Errors {
+			errs = append(errs, e.What)
+		}
+		return fmt.Errorf("Consul transaction rolled back: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// ----- TlsVaultStorage -----
+
+func (fs *TlsVaultStorage) WriteBundle(ctx context.Context, stem string, files map[string][]byte) error {
+	data := make(map[string]interface{}, len(files))
+	for ext, b := range files {
+		if b != nil {
+			data[ext] = base64.StdEncoding.EncodeToString(b)
+		}
+	}
+	if err := fs.writeSecret(stem+vaultBundleSuffix, data); err != nil {
+		return err
+	}
+
+	// plain secrets written before bundles existed are no longer used
+	for ext := range files {
+		if err := fs.deleteSecret(stem + ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
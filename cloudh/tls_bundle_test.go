@@ -0,0 +1,216 @@
+package cloudh
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestTlsFileStorageWriteBundle(t *testing.T) {
+	ctx := context.Background()
+	fs := &TlsFileStorage{}
+	stem := filepath.Join(t.TempDir(), "a.com")
+	bundleDir := filepath.Join(filepath.Dir(stem), fileBundleDir, "a.com")
+	versions := func() int {
+		entries, err := ioutil.ReadDir(bundleDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, e := range entries {
+			if e.IsDir() {
+				n++
+			}
+		}
+		return n
+	}
+
+	writes := []struct {
+		files    map[string][]byte
+		want     map[string]string
+		versions int
+	}{
+		{
+			files:    map[string][]byte{".crt": []byte("crt1"), ".key": []byte("key1"), ".ca": []byte("ca1")},
+			want:     map[string]string{".crt": "crt1", ".key": "key1", ".ca": "ca1"},
+			versions: 1,
+		},
+		{
+			files:    map[string][]byte{".crt": []byte("crt2"), ".key": []byte("key2"), ".ca": nil},
+			want:     map[string]string{".crt": "crt2", ".key": "key2"},
+			versions: 2,
+		},
+		{
+			files:    map[string][]byte{".crt": []byte("crt3"), ".key": []byte("key3")},
+			want:     map[string]string{".crt": "crt3", ".key": "key3"},
+			versions: 2,
+		},
+	}
+	for i, w := range writes {
+		// path resolved before the switch stays readable
+		before, _ := filepath.EvalSymlinks(stem + ".crt")
+
+		if err := fs.WriteBundle(ctx, stem, w.files); err != nil {
+			t.Fatalf("write %d: WriteBundle() = %v", i, err)
+		}
+		for _, ext := range []string{".crt", ".key", ".ca"} {
+			want, ok := w.want[ext]
+			b, err := fs.Read(ctx, stem+ext)
+			if !ok {
+				if !os.IsNotExist(err) {
+					t.Errorf("write %d: Read(%s) = %q, %v, want removed", i, ext, b, err)
+				}
+				continue
+			}
+			if err != nil || string(b) != want {
+				t.Errorf("write %d: Read(%s) = %q, %v, want %q", i, ext, b, err, want)
+			}
+			if target, _ := os.Readlink(stem + ext); !strings.HasPrefix(target, fileBundleDir) {
+				t.Errorf("write %d: %s links to %q, want bundle", i, ext, target)
+			}
+		}
+		if got := versions(); got != w.versions {
+			t.Errorf("write %d: %d versions kept, want %d", i, got, w.versions)
+		}
+
+		if before != "" {
+			if b, err := ioutil.ReadFile(before); err != nil || len(b) == 0 {
+				t.Errorf("write %d: previous .crt = %q, %v", i, b, err)
+			}
+		}
+	}
+}
+
+// testConsulTxn serves Consul transaction endpoint applying KV set/delete
+// operations to the returned map, transactions are rolled back when fail is set.
+func testConsulTxn(t *testing.T, fail *bool) (*consulapi.KV, map[string][]byte) {
+	t.Helper()
+	kv := make(map[string][]byte)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/v1/txn" {
+			http.NotFound(w, r)
+			return
+		}
+		var ops []struct {
+			KV struct {
+				Verb  string
+				Key   string
+				Value []byte
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if *fail {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Errors": []map[string]interface{}{{"OpIndex": 0, "What": "permission denied"}},
+			})
+			return
+		}
+
+		results := make([]map[string]interface{}, 0, len(ops))
+		for _, op := range ops {
+			switch op.KV.Verb {
+			case string(consulapi.KVSet):
+				kv[op.KV.Key] = op.KV.Value
+				results = append(results, map[string]interface{}{"KV": map[string]interface{}{"Key": op.KV.Key}})
+			case string(consulapi.KVDelete):
+				delete(kv, op.KV.Key)
+			default:
+				http.Error(w, "unsupported verb "+op.KV.Verb, http.StatusBadRequest)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Results": results})
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.KV(), kv
+}
+
+func TestTlsConsulStorageWriteBundle(t *testing.T) {
+	fail := false
+	kv, store := testConsulTxn(t, &fail)
+	fs := &TlsConsulStorage{KV: kv}
+	store["tls/a.com.ca"] = []byte("ca1")
+
+	err := fs.WriteBundle(context.Background(), "tls/a.com", map[string][]byte{".crt": []byte("crt"), ".key": []byte("key"), ".ca": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(store["tls/a.com.crt"]) != "crt" || string(store["tls/a.com.key"]) != "key" {
+		t.Errorf("KV = %q", store)
+	}
+	if _, ok := store["tls/a.com.ca"]; ok {
+		t.Errorf("tls/a.com.ca = %q, want deleted", store["tls/a.com.ca"])
+	}
+
+	fail = true
+	err = fs.WriteBundle(context.Background(), "tls/a.com", map[string][]byte{".crt": []byte("crt2"), ".key": []byte("key2")})
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("WriteBundle() = %v, want rolled back transaction", err)
+	}
+	if string(store["tls/a.com.crt"]) != "crt" {
+		t.Errorf("tls/a.com.crt = %q after rollback", store["tls/a.com.crt"])
+	}
+}
+
+func TestTlsVaultStorageWriteBundle(t *testing.T) {
+	ctx := context.Background()
+	for _, version := range []int{1, 2} {
+		logical, secrets := testVaultKv(t, version)
+		fs := &TlsVaultStorage{Logical: logical, Mount: "secret", KVVersion: version}
+		// plain secret written before bundles existed
+		if err := fs.Write(ctx, "tls/a.com.ca", []byte("ca1")); err != nil {
+			t.Fatal(err)
+		}
+
+		err := fs.WriteBundle(ctx, "tls/a.com", map[string][]byte{".crt": []byte("crt"), ".key": []byte("key"), ".ca": nil})
+		if err != nil {
+			t.Fatalf("v%d WriteBundle() = %v", version, err)
+		}
+		bundle, ok := secrets["tls/a.com"+vaultBundleSuffix]
+		if !ok || len(bundle) != 2 {
+			t.Fatalf("v%d bundle secret = %v, want .crt and .key", version, bundle)
+		}
+		if _, ok = secrets["tls/a.com.ca"]; ok {
+			t.Errorf("v%d plain .ca secret kept", version)
+		}
+
+		for ext, want := range map[string]string{".crt": "crt", ".key": "key"} {
+			b, err := fs.Read(ctx, "tls/a.com"+ext)
+			if err != nil || string(b) != want {
+				t.Errorf("v%d Read(%s) = %q, %v, want %q", version, ext, b, err, want)
+			}
+		}
+		if found, err := fs.Find(ctx, "tls", ".crt"); err != nil || len(found) != 1 || found[0] != "tls/a.com.crt" {
+			t.Errorf("v%d Find() = %v, %v", version, found, err)
+		}
+
+		// single file write goes into the bundle
+		if err = fs.Write(ctx, "tls/a.com.crt", []byte("crt2")); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := fs.Read(ctx, "tls/a.com.crt"); string(b) != "crt2" {
+			t.Errorf("v%d Read(.crt) after Write = %q", version, b)
+		}
+		if _, ok = secrets["tls/a.com.crt"]; ok {
+			t.Errorf("v%d Write created plain secret next to bundle", version)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package cloudh
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+const (
+	tlsCaRootValidity         = 10 * 365 * 24 * time.Hour
+	tlsCaIntermediateValidity = 5 * 365 * 24 * time.Hour
+	tlsCaLeafValidity         = 90 * 24 * time.Hour
+	tlsCaCrlValidity          = 7 * 24 * time.Hour
+	// CurrentCrl re-signs CRL expiring within this time
+	tlsCaCrlRefresh = 2 * 24 * time.Hour
+
+	// CRL reason codes (RFC 5280 5.3.1)
+	tlsCaReasonUnspecified = 0
+	tlsCaReasonSuperseded  = 4
+)
+
+var oidCrlReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// TlsCa is a private CA (root + intermediate) kept in Storage under CaPathPrefix.
+// Leaf certificates are stored under CertPathPrefix using the same
+// .key/.crt/.ca/.json layout as ACME certificates.
+type TlsCa struct {
+	Storage        TlsStorage
+	CaPathPrefix   string
+	CertPathPrefix string
+	KeyType        certcrypto.KeyType
+	Validity       time.Duration // leaf validity, 90 days by default
+	CrlURL         string        // CRL distribution point added to leaf certificates
+	ArchiveRevoked bool
+	Deploy         map[string][]TlsDeployTarget
+}
+
+// TlsCaRevoked is an entry of revoked.json, CRL is built from these.
+type TlsCaRevoked struct {
+	Serial    string    `json:"serial"`
+	Domain    string    `json:"domain"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason,omitempty"` // CRL reason code, 4 for certificates replaced by renew
+}
+
+// Init creates root and intermediate CA, fails when CA already exists.
+func (c *TlsCa) Init(name string) error {
+	exists, err := c.Storage.Exists(context.TODO(), c.caFile("root.crt"))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("CA already exists in %s", c.CaPathPrefix)
+	}
+
+	now := time.Now()
+	rootKey, err := certcrypto.GeneratePrivateKey(c.keyType())
+	if err != nil {
+		return err
+	}
+	root := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name + " Root CA"},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(tlsCaRootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+	rootCert, err := c.sign(root, rootKey, nil, rootKey)
+	if err != nil {
+		return err
+	}
+
+	interKey, err := certcrypto.GeneratePrivateKey(c.keyType())
+	if err != nil {
+		return err
+	}
+	inter := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name + " Intermediate CA"},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(tlsCaIntermediateValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true,
+	}
+	interCert, err := c.sign(inter, interKey, rootCert, rootKey)
+	if err != nil {
+		return err
+	}
+
+	files := map[string][]byte{
+		"root.key":         pem.EncodeToMemory(certcrypto.PEMBlock(rootKey)),
+		"root.crt":         pemCertificates([]*x509.Certificate{rootCert}),
+		"intermediate.key": pem.EncodeToMemory(certcrypto.PEMBlock(interKey)),
+		"intermediate.crt": pemCertificates([]*x509.Certificate{interCert}),
+	}
+	// root last, existing root.crt marks complete CA
+	for _, name := range []string{"root.key", "intermediate.key", "intermediate.crt", "root.crt"} {
+		if err := c.Storage.Write(context.TODO(), c.caFile(name), files[name]); err != nil {
+			return err
+		}
+	}
+	_, err = c.Crl()
+	return err
+}
+
+// Issue signs new leaf certificate (server and client auth) for domains and ips.
+// Certificate is stored under the first domain (or the first IP).
+func (c *TlsCa) Issue(domains []string, ips []net.IP) error {
+	if len(domains) == 0 && len(ips) == 0 {
+		return errors.New("Domain or IP is not specified")
+	}
+	interCert, interKey, err := c.intermediate()
+	if err != nil {
+		return err
+	}
+
+	name := c.leafName(domains, ips)
+	key, err := certcrypto.GeneratePrivateKey(c.keyType())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    domains,
+		IPAddresses: ips,
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    now.Add(c.validity()),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		tpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if c.CrlURL != "" {
+		tpl.CRLDistributionPoints = []string{c.CrlURL}
+	}
+	cert, err := c.sign(tpl, key, interCert, interKey)
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.MarshalIndent(TlsCertMeta{
+		Domains:  append(append([]string{}, domains...), ipStrings(ips)...),
+		KeyType:  TlsKeyTypeName(tlsPublicKeyType(cert.PublicKey)),
+		Issuer:   cert.Issuer.CommonName,
+		Serial:   cert.SerialNumber.Text(16),
+		IssuedAt: cert.NotBefore,
+		NotAfter: cert.NotAfter,
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	at := c.tls()
+	err = at.saveFiles(name, map[string][]byte{
+		".key":  pem.EncodeToMemory(certcrypto.PEMBlock(key)),
+		".crt":  pemCertificates([]*x509.Certificate{cert, interCert}),
+		".ca":   pemCertificates([]*x509.Certificate{interCert}),
+		".json": meta,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Certificate issued, serial %s", name, cert.SerialNumber.Text(16))
+	return at.deployIssued(name)
+}
+
+// Renew reissues certificates (all issued by this CA when domains are empty)
+// expiring within days, keeping their SANs.
+func (c *TlsCa) Renew(domains []string, days int) ([]TlsRenewResult, error) {
+	certs, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]TlsRenewResult, 0)
+	for _, cert := range certs {
+		name := strings.TrimSuffix(filepath.Base(cert.Path), ".crt")
+		if len(domains) > 0 && !containsDomain(domains, name, cert.CommonName) {
+			continue
+		}
+		res := TlsRenewResult{Domain: name}
+		if cert.DaysLeft <= days {
+			res.Err = c.reissue(cert.Path)
+			res.Renewed = res.Err == nil
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// List returns stored certificates issued by this CA.
+func (c *TlsCa) List() ([]TlsCert, error) {
+	interCert, _, err := c.intermediate()
+	if err != nil {
+		return nil, err
+	}
+	at := c.tls()
+	all, err := at.List()
+	if err != nil {
+		return nil, err
+	}
+
+	certs := make([]TlsCert, 0)
+	for _, cert := range all {
+		leaf, err := at.readCertificate(strings.TrimSuffix(filepath.Base(cert.Path), ".crt"), ".crt")
+		if err != nil {
+			return nil, err
+		}
+		if leaf[0].CheckSignatureFrom(interCert) == nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// Revoke adds certificate of domain to CRL and removes (or archives) its files.
+func (c *TlsCa) Revoke(domain string) error {
+	interCert, _, err := c.intermediate()
+	if err != nil {
+		return err
+	}
+	at := c.tls()
+	certs, err := at.readCertificate(domain, ".crt")
+	if err != nil {
+		return err
+	}
+	if certs[0].CheckSignatureFrom(interCert) != nil {
+		return fmt.Errorf("[%s] Certificate was not issued by this CA", domain)
+	}
+
+	if err = c.revoke(certs[0], domain, tlsCaReasonUnspecified); err != nil {
+		return err
+	}
+	return at.deleteResource(domain)
+}
+
+// revoke adds cert to revoked.json and signs fresh CRL. revoked.json is
+// updated under lock so concurrent revocations don't drop each other's entries.
+func (c *TlsCa) revoke(cert *x509.Certificate, domain string, reason int) error {
+	lock := &AutoTls{
+		Config:  TlsConfig{CertPathPrefix: c.CaPathPrefix, LockWait: true},
+		Storage: c.Storage,
+	}
+	_, err := lock.withLock("revoked.json", func() error {
+		revoked, err := c.revoked()
+		if err != nil {
+			return err
+		}
+		revoked = append(revoked, TlsCaRevoked{
+			Serial:    cert.SerialNumber.Text(16),
+			Domain:    domain,
+			RevokedAt: time.Now().UTC(),
+			Reason:    reason,
+		})
+		b, err := json.MarshalIndent(revoked, "", "\t")
+		if err != nil {
+			return err
+		}
+		if err = c.Storage.Write(context.TODO(), c.caFile("revoked.json"), b); err != nil {
+			return err
+		}
+		_, err = c.Crl()
+		return err
+	})
+	return err
+}
+
+// Crl signs fresh CRL (valid for 7 days) and stores it as crl.pem.
+func (c *TlsCa) Crl() ([]byte, error) {
+	interCert, interKey, err := c.intermediate()
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := c.revoked()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, r := range revoked {
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("Invalid serial %s in revoked.json", r.Serial)
+		}
+		entry := pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: r.RevokedAt}
+		if r.Reason != tlsCaReasonUnspecified {
+			reason, err := asn1.Marshal(asn1.Enumerated(r.Reason))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidCrlReasonCode, Value: reason}}
+		}
+		entries = append(entries, entry)
+	}
+
+	signer, ok := interKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported private key")
+	}
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(tlsCaCrlValidity),
+	}, interCert, signer)
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	return b, c.Storage.Write(context.TODO(), c.caFile("crl.pem"), b)
+}
+
+// CurrentCrl returns stored CRL (PEM), it is signed again first
+// when missing or expiring within 2 days.
+func (c *TlsCa) CurrentCrl() ([]byte, error) {
+	key := c.caFile("crl.pem")
+	exists, err := c.Storage.Exists(context.TODO(), key)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		b, err := c.Storage.Read(context.TODO(), key)
+		if err != nil {
+			return nil, err
+		}
+		if block, _ := pem.Decode(b); block != nil {
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err == nil && time.Until(crl.NextUpdate) > tlsCaCrlRefresh {
+				return b, nil
+			}
+		}
+	}
+	return c.Crl()
+}
+
+// RootCertificate returns PEM of the root CA (to be added to trust stores).
+func (c *TlsCa) RootCertificate() ([]byte, error) {
+	return c.Storage.Read(context.TODO(), c.caFile("root.crt"))
+}
+
+// reissue issues certificate stored at path again and revokes the superseded one.
+func (c *TlsCa) reissue(path string) error {
+	name := strings.TrimSuffix(filepath.Base(path), ".crt")
+	certs, err := c.tls().readCertificate(name, ".crt")
+	if err != nil {
+		return err
+	}
+	// failed deploy still leaves the new certificate stored
+	var deployErr *TlsDeployError
+	err = c.Issue(certs[0].DNSNames, certs[0].IPAddresses)
+	if err != nil && !errors.As(err, &deployErr) {
+		return err
+	}
+	if rerr := c.revoke(certs[0], name, tlsCaReasonSuperseded); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (c *TlsCa) sign(tpl *x509.Certificate, key crypto.PrivateKey, parent *x509.Certificate, parentKey crypto.PrivateKey) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tpl.SerialNumber = serial
+	if parent == nil {
+		parent = tpl
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported private key")
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, signer.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (c *TlsCa) intermediate() (*x509.Certificate, crypto.PrivateKey, error) {
+	b, err := c.Storage.Read(context.TODO(), c.caFile("intermediate.crt"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("CA is not initialized in %s: %w", c.CaPathPrefix, err)
+	}
+	cert, err := certcrypto.ParsePEMCertificate(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err = c.Storage.Read(context.TODO(), c.caFile("intermediate.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePrivateKey(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func (c *TlsCa) revoked() ([]TlsCaRevoked, error) {
+	revoked := make([]TlsCaRevoked, 0)
+	_, err := (&AutoTls{Storage: c.Storage}).readJson(c.caFile("revoked.json"), &revoked)
+	return revoked, err
+}
+
+func (c *TlsCa) tls() *AutoTls {
+	return &AutoTls{
+		Config: TlsConfig{
+			CertPathPrefix: c.CertPathPrefix,
+			ArchiveRevoked: c.ArchiveRevoked,
+			Deploy:         c.Deploy,
+		},
+		Storage:        c.Storage,
+		AccountStorage: &TlsNullStorage{},
+	}
+}
+
+func (c *TlsCa) caFile(name string) string {
+	return filepath.Join(c.CaPathPrefix, name)
+}
+
+func (c *TlsCa) leafName(domains []string, ips []net.IP) string {
+	if len(domains) > 0 {
+		return domains[0]
+	}
+	return ips[0].String()
+}
+
+func (c *TlsCa) keyType() certcrypto.KeyType {
+	if c.KeyType != "" {
+		return c.KeyType
+	}
+	return tlsDefaultKeyType
+}
+
+func (c *TlsCa) validity() time.Duration {
+	if c.Validity > 0 {
+		return c.Validity
+	}
+	return tlsCaLeafValidity
+}
+
+func containsDomain(domains []string, names ...string) bool {
+	for _, d := range domains {
+		for _, n := range names {
+			if d == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ipStrings(ips []net.IP) []string {
+	res := make([]string, len(ips))
+	for i, ip := range ips {
+		res[i] = ip.String()
+	}
+	return res
+}
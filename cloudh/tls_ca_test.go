@@ -0,0 +1,145 @@
+package cloudh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTlsCaRenewRevokesSuperseded(t *testing.T) {
+	dir := t.TempDir()
+	ca := &TlsCa{
+		Storage:        &TlsFileStorage{},
+		CaPathPrefix:   filepath.Join(dir, "ca"),
+		CertPathPrefix: filepath.Join(dir, "tls"),
+	}
+	if err := ca.Init("Test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Issue([]string{"a.consul"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ca.List()
+	if err != nil || len(certs) != 1 {
+		t.Fatalf("List() = %v, %v", certs, err)
+	}
+	old := certs[0].Serial
+
+	results, err := ca.Renew(nil, 365)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0].Renewed {
+		t.Fatalf("Renew() = %+v", results)
+	}
+
+	revoked, err := ca.revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].Serial != old || revoked[0].Reason != tlsCaReasonSuperseded {
+		t.Fatalf("revoked = %+v, want superseded %s", revoked, old)
+	}
+
+	b, err := ca.Storage.Read(context.Background(), ca.caFile("crl.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].ReasonCode != tlsCaReasonSuperseded {
+		t.Errorf("CRL entries = %+v", crl.RevokedCertificateEntries)
+	}
+}
+
+func TestTlsCaRevokeCrl(t *testing.T) {
+	dir := t.TempDir()
+	ca := &TlsCa{
+		Storage:        &TlsFileStorage{},
+		CaPathPrefix:   filepath.Join(dir, "ca"),
+		CertPathPrefix: filepath.Join(dir, "tls"),
+	}
+	if err := ca.Init("Test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"a.consul", "b.consul"} {
+		if err := ca.Issue([]string{domain}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs, err := ca.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serials := make(map[string]string)
+	for _, cert := range certs {
+		serials[cert.CommonName] = cert.Serial
+	}
+
+	if err = ca.Revoke("a.consul"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ca.Crl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl := testParseCrl(t, b)
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Text(16) != serials["a.consul"] {
+		t.Fatalf("CRL entries = %+v, want %s", crl.RevokedCertificateEntries, serials["a.consul"])
+	}
+
+	// fresh CRL is served as stored
+	current, err := ca.CurrentCrl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(current, b) {
+		t.Error("CurrentCrl() signed fresh CRL again")
+	}
+
+	// CRL close to expiry is signed again
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuer := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Old"}, KeyUsage: x509.KeyUsageCRLSign, SubjectKeyId: []byte{1}}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-6 * 24 * time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, issuer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ca.Storage.Write(context.Background(), ca.caFile("crl.pem"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+	if current, err = ca.CurrentCrl(); err != nil {
+		t.Fatal(err)
+	}
+	if crl = testParseCrl(t, current); time.Until(crl.NextUpdate) < tlsCaCrlRefresh || len(crl.RevokedCertificateEntries) != 1 {
+		t.Errorf("CurrentCrl() next update %s with %d entries, want re-signed", crl.NextUpdate, len(crl.RevokedCertificateEntries))
+	}
+}
+
+func testParseCrl(t *testing.T, b []byte) *x509.RevocationList {
+	t.Helper()
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatalf("invalid CRL %q", b)
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
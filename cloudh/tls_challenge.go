@@ -0,0 +1,112 @@
+package cloudh
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/go-acme/lego/v4/lego"
+)
+
+const (
+	TlsChallengeDns01     = "dns-01"
+	TlsChallengeHttp01    = "http-01"
+	TlsChallengeTlsAlpn01 = "tls-alpn-01"
+)
+
+// TlsStorageChallengeProvider keeps HTTP-01/TLS-ALPN-01 key authorizations
+// in storage, so any node serving the same storage can answer the challenge
+// (regardless of which node started the order).
+type TlsStorageChallengeProvider struct {
+	Storage TlsStorage
+	Prefix  string
+	Kind    string
+}
+
+// TlsChallengeKey returns storage key of key authorization, name is
+// the token for HTTP-01 and the domain for TLS-ALPN-01.
+func TlsChallengeKey(prefix, kind, name string) string {
+	return filepath.Join(prefix, kind, name)
+}
+
+func (p *TlsStorageChallengeProvider) Present(domain, token, keyAuth string) error {
+	return p.Storage.Write(context.TODO(), p.key(domain, token), []byte(keyAuth))
+}
+
+func (p *TlsStorageChallengeProvider) CleanUp(domain, token, keyAuth string) error {
+	return p.Storage.Delete(context.TODO(), p.key(domain, token))
+}
+
+func (p *TlsStorageChallengeProvider) key(domain, token string) string {
+	if p.Kind == TlsChallengeTlsAlpn01 {
+		return TlsChallengeKey(p.Prefix, p.Kind, domain)
+	}
+	return TlsChallengeKey(p.Prefix, p.Kind, token)
+}
+
+// TlsAlpnGetCertificate returns tls.Config.GetCertificate answering
+// TLS-ALPN-01 challenges with key authorizations kept in storage.
+func TlsAlpnGetCertificate(storage TlsStorage, prefix string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		alpn := false
+		for _, proto := range hello.SupportedProtos {
+			alpn = alpn || proto == tlsalpn01.ACMETLS1Protocol
+		}
+		if !alpn || hello.ServerName == "" {
+			return nil, errors.New("Not an ACME TLS-ALPN-01 challenge")
+		}
+
+		keyAuth, err := storage.Read(context.TODO(), TlsChallengeKey(prefix, TlsChallengeTlsAlpn01, hello.ServerName))
+		if err != nil {
+			return nil, fmt.Errorf("No challenge for %s: %w", hello.ServerName, err)
+		}
+		return tlsalpn01.ChallengeCert(hello.ServerName, string(keyAuth))
+	}
+}
+
+func (at *AutoTls) setupChallenge(client *lego.Client) error {
+	switch at.Config.Challenge {
+	case "", TlsChallengeDns01:
+		return at.setupDnsChallenge(client)
+
+	case TlsChallengeHttp01:
+		return client.Challenge.SetHTTP01Provider(&TlsStorageChallengeProvider{
+			Storage: at.challengeStorage(),
+			Prefix:  at.challengePathPrefix(),
+			Kind:    TlsChallengeHttp01,
+		})
+
+	case TlsChallengeTlsAlpn01:
+		return client.Challenge.SetTLSALPN01Provider(&TlsStorageChallengeProvider{
+			Storage: at.challengeStorage(),
+			Prefix:  at.challengePathPrefix(),
+			Kind:    TlsChallengeTlsAlpn01,
+		})
+	}
+
+	return fmt.Errorf("Unknown challenge %s", at.Config.Challenge)
+}
+
+// challengeStorage returns Storage without encryption, key authorizations
+// are public anyway and owl agent reads them from the underlying storage.
+func (at *AutoTls) challengeStorage() TlsStorage {
+	if es, ok := at.Storage.(*TlsEncryptedStorage); ok {
+		return es.Storage
+	}
+	return at.Storage
+}
+
+func (at *AutoTls) challengePathPrefix() string {
+	if at.Config.ChallengePathPrefix != "" {
+		return at.Config.ChallengePathPrefix
+	}
+	return TlsDefaultChallengePath(at.Config.CertPathPrefix)
+}
+
+// TlsDefaultChallengePath is used when challenge path is not configured.
+func TlsDefaultChallengePath(certPathPrefix string) string {
+	return filepath.Join(certPathPrefix, "acme-challenge")
+}
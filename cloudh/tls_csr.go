@@ -0,0 +1,113 @@
+package cloudh
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// IssueCsr requests certificate for caller supplied CSR (PEM). Private key stays
+// with the caller, only .crt/.ca/.json and the CSR (.csr, used by Renew) are stored.
+func (at *AutoTls) IssueCsr(csrPem []byte) (err error) {
+	defer func(start time.Time) { tlsObserve("issue", start, err) }(time.Now())
+
+	csr, err := parseCsr(csrPem)
+	if err != nil {
+		return err
+	}
+	issuer, err := at.issuer(true)
+	if err != nil {
+		return err
+	}
+
+	domains := csrDomains(csr)
+	_, err = at.withLock(domains[0], func() error {
+		return at.obtainCsr(issuer, csr)
+	})
+	return err
+}
+
+// readCsr returns stored CSR of domain, nil when certificate was issued with own key.
+func (at *AutoTls) readCsr(domain string) (*x509.CertificateRequest, error) {
+	key := at.getCertFileName(domain, ".csr")
+	exists, err := at.Storage.Exists(context.TODO(), key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	b, err := at.Storage.Read(context.TODO(), key)
+	if err != nil {
+		return nil, err
+	}
+	return parseCsr(b)
+}
+
+func (at *AutoTls) obtainCsr(issuer TlsIssuer, csr *x509.CertificateRequest) error {
+	domain := csrDomains(csr)[0]
+
+	if !at.Config.SkipPreflight {
+		if _, err := at.Preflight(csrDomains(csr)); err != nil {
+			return fmt.Errorf("[%s] %w", domain, err)
+		}
+	}
+
+	if err := at.ctx().Err(); err != nil {
+		return err
+	}
+	res, err := issuer.ObtainForCSR(csr)
+	if err != nil {
+		return err
+	}
+	meta, err := at.certMeta(res, issuer)
+	if err != nil {
+		return err
+	}
+
+	// key of a previous certificate would not match anymore
+	files := map[string][]byte{
+		".key":  nil,
+		".crt":  res.Certificate,
+		".ca":   nil,
+		".csr":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}),
+		".json": meta,
+	}
+	if len(res.IssuerCertificate) > 0 {
+		files[".ca"] = res.IssuerCertificate
+	}
+	if err = at.saveFiles(domain, files); err != nil {
+		return err
+	}
+	return at.deployIssued(domain)
+}
+
+func parseCsr(b []byte) (*x509.CertificateRequest, error) {
+	if block, _ := pem.Decode(b); block == nil {
+		return nil, errors.New("CSR is not PEM encoded")
+	}
+	csr, err := certcrypto.PemDecodeTox509CSR(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CSR: %w", err)
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("Invalid CSR signature: %w", err)
+	}
+	if len(csrDomains(csr)) == 0 {
+		return nil, errors.New("CSR has no common name nor SANs")
+	}
+	return csr, nil
+}
+
+// csrDomains returns common name and SANs of csr (IP SANs included).
+func csrDomains(csr *x509.CertificateRequest) []string {
+	domains := make([]string, 0)
+	for _, d := range append(append([]string{csr.Subject.CommonName}, csr.DNSNames...), ipStrings(csr.IPAddresses)...) {
+		if d != "" && len(diffDomains([]string{d}, domains)) > 0 {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
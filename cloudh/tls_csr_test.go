@@ -0,0 +1,111 @@
+package cloudh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestCsrDomains(t *testing.T) {
+	tests := []struct {
+		name string
+		csr  *x509.CertificateRequest
+		want []string
+	}{
+		{
+			name: "common name only",
+			csr:  &x509.CertificateRequest{Subject: pkix.Name{CommonName: "a.com"}},
+			want: []string{"a.com"},
+		},
+		{
+			name: "common name repeated in SANs",
+			csr:  &x509.CertificateRequest{Subject: pkix.Name{CommonName: "a.com"}, DNSNames: []string{"a.com", "www.a.com"}},
+			want: []string{"a.com", "www.a.com"},
+		},
+		{
+			name: "SANs without common name",
+			csr:  &x509.CertificateRequest{DNSNames: []string{"www.a.com", "a.com"}},
+			want: []string{"www.a.com", "a.com"},
+		},
+		{
+			name: "duplicate SANs differing in case",
+			csr:  &x509.CertificateRequest{DNSNames: []string{"a.com", "A.com"}},
+			want: []string{"a.com"},
+		},
+		{
+			name: "IP SANs",
+			csr:  &x509.CertificateRequest{Subject: pkix.Name{CommonName: "a.com"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+			want: []string{"a.com", "10.0.0.1"},
+		},
+		{
+			name: "IP common name",
+			csr:  &x509.CertificateRequest{Subject: pkix.Name{CommonName: "10.0.0.1"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+			want: []string{"10.0.0.1"},
+		},
+		{
+			name: "empty",
+			csr:  &x509.CertificateRequest{},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := csrDomains(tt.csr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("csrDomains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTlsIssueReplacesCsr(t *testing.T) {
+	at := &AutoTls{
+		Config: TlsConfig{
+			Domains:        []string{"a.internal"},
+			CertPathPrefix: t.TempDir(),
+			SkipPreflight:  true,
+		},
+		Storage: &TlsFileStorage{},
+		Issuer:  &TlsVaultPkiIssuer{Logical: testVaultPki(t, "pki/sign/web", true), Role: "web"},
+	}
+	exists := func(ext string) bool {
+		ok, err := at.Storage.Exists(context.Background(), at.getCertFileName("a.internal", ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"a.internal"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = at.IssueCsr(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(".csr") || exists(".key") {
+		t.Fatalf("after IssueCsr .csr = %v, .key = %v", exists(".csr"), exists(".key"))
+	}
+
+	if err = at.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(".csr") || !exists(".key") {
+		t.Fatalf("after Issue .csr = %v, .key = %v", exists(".csr"), exists(".key"))
+	}
+
+	// test certificates expire within an hour, so Renew always renews
+	if err = at.Renew(false); err != nil {
+		t.Fatal(err)
+	}
+	if exists(".csr") || !exists(".key") {
+		t.Errorf("after Renew .csr = %v, .key = %v", exists(".csr"), exists(".key"))
+	}
+}
@@ -0,0 +1,346 @@
+package cloudh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"gopkg.in/yaml.v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Deploy formats.
+const (
+	TlsDeployFullchain = "fullchain" // leaf + chain, optionally key to KeyPath
+	TlsDeployHaproxy   = "haproxy"   // key + leaf + chain in a single file
+	TlsDeployPkcs12    = "pkcs12"    // key + leaf + chain, password protected
+	TlsDeploySplit     = "split"     // leaf to Path, chain to ChainPath, key to KeyPath
+)
+
+// TlsDeployTarget describes where (and in which format) certificate is written
+// after it changes. Hook is run through sh with OWL_* environment variables.
+type TlsDeployTarget struct {
+	Format    string `yaml:"format"`
+	Path      string `yaml:"path"`
+	KeyPath   string `yaml:"key_path,omitempty"`
+	ChainPath string `yaml:"chain_path,omitempty"`
+	Password  string `yaml:"password,omitempty"`
+	Mode      string `yaml:"mode,omitempty"`
+	Owner     string `yaml:"owner,omitempty"`
+	Group     string `yaml:"group,omitempty"`
+	Hook      string `yaml:"hook,omitempty"`
+}
+
+// LoadTlsDeployTargets reads YAML file mapping domains to deploy targets.
+func LoadTlsDeployTargets(path string) (map[string][]TlsDeployTarget, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string][]TlsDeployTarget)
+	if err = yaml.UnmarshalStrict(b, &targets); err != nil {
+		return nil, fmt.Errorf("Invalid deploy config %s: %w", path, err)
+	}
+	for domain, list := range targets {
+		for _, t := range list {
+			if err := t.validate(); err != nil {
+				return nil, fmt.Errorf("[%s] %w", domain, err)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// TlsDeployError is returned by issue/renew when certificate was stored
+// but deploying it failed, the deploy is retried by the next renew.
+type TlsDeployError struct {
+	Domain string
+	Err    error
+}
+
+func (e *TlsDeployError) Error() string {
+	return fmt.Sprintf("%v (certificate was stored, deploy is retried by the next renew)", e.Err)
+}
+
+func (e *TlsDeployError) Unwrap() error {
+	return e.Err
+}
+
+// Deploy writes stored certificate of domain to configured targets
+// and runs hooks of targets that changed. Failure is recorded in metadata
+// (DeployError), so renew retries it even when certificate is not due.
+func (at *AutoTls) Deploy(domain string) error {
+	return at.deploy(domain, false)
+}
+
+// deploy runs hooks of unchanged targets as well when force is set.
+func (at *AutoTls) deploy(domain string, force bool) error {
+	err := at.deployTargets(domain, force)
+	if merr := at.markDeploy(domain, err); merr != nil {
+		log.Printf("[%s] Failed to record deploy status: %v", domain, merr)
+	}
+	return err
+}
+
+// deployIssued deploys certificate that was just stored.
+func (at *AutoTls) deployIssued(domain string) error {
+	if err := at.deploy(domain, false); err != nil {
+		return &TlsDeployError{Domain: domain, Err: err}
+	}
+	return nil
+}
+
+// retryDeploy deploys certificate again when previous deploy failed,
+// hooks are run even when files did not change (the hook may have failed).
+func (at *AutoTls) retryDeploy(domain string) error {
+	var meta TlsCertMeta
+	ok, err := at.readJson(at.getCertFileName(domain, ".json"), &meta)
+	if !ok || err != nil || meta.DeployError == "" {
+		return err
+	}
+	log.Printf("[%s] Retrying deploy, previous attempt failed: %s", domain, meta.DeployError)
+	if err = at.deploy(domain, true); err != nil {
+		return &TlsDeployError{Domain: domain, Err: err}
+	}
+	return nil
+}
+
+// markDeploy stores deployErr in metadata of domain (cleared on success).
+func (at *AutoTls) markDeploy(domain string, deployErr error) error {
+	key := at.getCertFileName(domain, ".json")
+	var meta TlsCertMeta
+	ok, err := at.readJson(key, &meta)
+	if !ok || err != nil {
+		return err
+	}
+
+	msg := ""
+	if deployErr != nil {
+		msg = deployErr.Error()
+	}
+	if meta.DeployError == msg {
+		return nil
+	}
+	meta.DeployError = msg
+	b, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return at.Storage.Write(context.TODO(), key, b)
+}
+
+func (at *AutoTls) deployTargets(domain string, force bool) error {
+	targets := at.Config.Deploy[domain]
+	if len(targets) == 0 {
+		return nil
+	}
+
+	// certificates issued from CSR have no key stored
+	var keyPem []byte
+	keyFile := at.getCertFileName(domain, ".key")
+	hasKey, err := at.Storage.Exists(context.TODO(), keyFile)
+	if err != nil {
+		return err
+	}
+	if hasKey {
+		if keyPem, err = at.Storage.Read(context.TODO(), keyFile); err != nil {
+			return fmt.Errorf("[%s] Error while loading the private key: %w", domain, err)
+		}
+	}
+	crtPem, err := at.Storage.Read(context.TODO(), at.getCertFileName(domain, ".crt"))
+	if err != nil {
+		return fmt.Errorf("[%s] Error while loading the certificate: %w", domain, err)
+	}
+
+	for _, t := range targets {
+		if keyPem == nil && t.needsKey() {
+			return fmt.Errorf("[%s] Deploy %s to %s requires private key, none is stored", domain, t.Format, t.Path)
+		}
+		changed, err := t.deploy(keyPem, crtPem)
+		if err != nil {
+			return fmt.Errorf("[%s] Deploy %s to %s failed: %w", domain, t.Format, t.Path, err)
+		}
+		if changed {
+			log.Printf("[%s] Deployed %s to %s", domain, t.Format, t.Path)
+		} else if !force {
+			continue
+		}
+
+		if err := t.runHook(domain); err != nil {
+			return fmt.Errorf("[%s] Deploy hook failed: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+func (t *TlsDeployTarget) validate() error {
+	if t.Path == "" {
+		return fmt.Errorf("Deploy target path is missing")
+	}
+	switch t.Format {
+	case TlsDeployFullchain, TlsDeployHaproxy:
+	case TlsDeployPkcs12:
+		if t.Password == "" {
+			return fmt.Errorf("Deploy target %s: password is missing", t.Path)
+		}
+	case TlsDeploySplit:
+		if t.KeyPath == "" || t.ChainPath == "" {
+			return fmt.Errorf("Deploy target %s: key_path and chain_path are required", t.Path)
+		}
+	default:
+		return fmt.Errorf("Deploy target %s: format must be one of: fullchain, haproxy, pkcs12, split", t.Path)
+	}
+	return nil
+}
+
+func (t *TlsDeployTarget) needsKey() bool {
+	return t.Format != TlsDeployFullchain || t.KeyPath != ""
+}
+
+// deploy reports whether any file was changed.
+func (t *TlsDeployTarget) deploy(keyPem, crtPem []byte) (bool, error) {
+	certs, err := certcrypto.ParsePEMBundle(crtPem)
+	if err != nil {
+		return false, err
+	}
+	leaf := pemCertificates(certs[:1])
+	chain := pemCertificates(certs[1:])
+
+	files := make(map[string][]byte)
+	secret := make(map[string]bool)
+	switch t.Format {
+	case TlsDeployFullchain:
+		files[t.Path] = crtPem
+		if t.KeyPath != "" {
+			files[t.KeyPath] = keyPem
+			secret[t.KeyPath] = true
+		}
+
+	case TlsDeployHaproxy:
+		files[t.Path] = append(append([]byte{}, keyPem...), crtPem...)
+		secret[t.Path] = true
+
+	case TlsDeploySplit:
+		files[t.Path] = leaf
+		files[t.ChainPath] = chain
+		files[t.KeyPath] = keyPem
+		secret[t.KeyPath] = true
+
+	case TlsDeployPkcs12:
+		// PKCS#12 encoding is randomized, compare certificate instead
+		if t.pkcs12Current(certs[0]) {
+			return false, nil
+		}
+		key, err := certcrypto.ParsePEMPrivateKey(keyPem)
+		if err != nil {
+			return false, err
+		}
+		pfx, err := pkcs12.Encode(rand.Reader, key, certs[0], certs[1:], t.Password)
+		if err != nil {
+			return false, err
+		}
+		files[t.Path] = pfx
+		secret[t.Path] = true
+	}
+
+	changed := false
+	for path, b := range files {
+		if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, b) {
+			continue
+		}
+		perm, err := t.perm(secret[path])
+		if err != nil {
+			return changed, err
+		}
+		fs := TlsFileStorage{Perms: map[string]TlsFilePerm{"": perm}}
+		if err := fs.writeAtomic(path, b); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func (t *TlsDeployTarget) pkcs12Current(leaf *x509.Certificate) bool {
+	b, err := ioutil.ReadFile(t.Path)
+	if err != nil {
+		return false
+	}
+	_, cert, _, err := pkcs12.DecodeChain(b, t.Password)
+	if err != nil {
+		return false
+	}
+	return sha256.Sum256(cert.Raw) == sha256.Sum256(leaf.Raw)
+}
+
+// perm defaults to 0600 for files containing private key, 0644 otherwise.
+func (t *TlsDeployTarget) perm(secret bool) (TlsFilePerm, error) {
+	perm := TlsFilePerm{Mode: 0o644, Uid: -1, Gid: -1}
+	if secret {
+		perm.Mode = 0o600
+	}
+	if t.Mode != "" {
+		mode, err := strconv.ParseUint(t.Mode, 8, 32)
+		if err != nil {
+			return perm, fmt.Errorf("Deploy target %s: mode must be octal", t.Path)
+		}
+		perm.Mode = os.FileMode(mode)
+	}
+	if t.Owner != "" {
+		u, err := user.Lookup(t.Owner)
+		if err != nil {
+			return perm, err
+		}
+		perm.Uid, _ = strconv.Atoi(u.Uid)
+	}
+	if t.Group != "" {
+		g, err := user.LookupGroup(t.Group)
+		if err != nil {
+			return perm, err
+		}
+		perm.Gid, _ = strconv.Atoi(g.Gid)
+	}
+	return perm, nil
+}
+
+func (t *TlsDeployTarget) runHook(domain string) error {
+	if t.Hook == "" {
+		return nil
+	}
+	return runTlsHook(t.Hook,
+		"OWL_DOMAIN="+domain,
+		"OWL_FORMAT="+t.Format,
+		"OWL_CERT_PATH="+t.Path,
+		"OWL_KEY_PATH="+t.KeyPath,
+		"OWL_CHAIN_PATH="+t.ChainPath,
+	)
+}
+
+// runTlsHook runs hook with sh -c, env is appended to process environment.
+func runTlsHook(hook string, env ...string) error {
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.Run()
+}
+
+func pemCertificates(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,103 @@
+package cloudh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// testCertificate returns self-signed certificate and key PEM of domains.
+func testCertificate(t *testing.T, domains ...string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(certcrypto.PEMBlock(key))
+}
+
+func TestDeployFailureIsRetried(t *testing.T) {
+	dir := t.TempDir()
+	at := &AutoTls{
+		Config: TlsConfig{
+			CertPathPrefix: dir,
+			Deploy: map[string][]TlsDeployTarget{
+				"a.com": {{
+					Format: TlsDeployFullchain,
+					Path:   filepath.Join(dir, "out", "a.com.pem"),
+					Hook:   "test -f " + filepath.Join(dir, "ok") + " && echo run >> " + filepath.Join(dir, "runs"),
+				}},
+			},
+		},
+		Storage: &TlsFileStorage{},
+	}
+	crt, key := testCertificate(t, "a.com")
+	meta, _ := json.Marshal(TlsCertMeta{Domains: []string{"a.com"}})
+	for ext, b := range map[string][]byte{".crt": crt, ".key": key, ".json": meta} {
+		if err := ioutil.WriteFile(at.getCertFileName("a.com", ext), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deployError := func() string {
+		var meta TlsCertMeta
+		if _, err := at.readJson(at.getCertFileName("a.com", ".json"), &meta); err != nil {
+			t.Fatal(err)
+		}
+		return meta.DeployError
+	}
+	runs := func() int {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "runs"))
+		return strings.Count(string(b), "run")
+	}
+
+	err := at.deployIssued("a.com")
+	var deployErr *TlsDeployError
+	if !errors.As(err, &deployErr) {
+		t.Fatalf("deployIssued() = %v, want TlsDeployError", err)
+	}
+	if deployError() == "" {
+		t.Fatal("deploy error was not recorded in metadata")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "ok"), nil, 0o600)
+	if err = at.retryDeploy("a.com"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := deployError(); msg != "" {
+		t.Errorf("deploy error = %q after successful retry", msg)
+	}
+	if runs() != 1 {
+		t.Errorf("hook runs = %d, want 1 (hook of unchanged target is run on retry)", runs())
+	}
+
+	if err = at.retryDeploy("a.com"); err != nil {
+		t.Fatal(err)
+	}
+	if runs() != 1 {
+		t.Errorf("hook runs = %d, want 1 (nothing to retry)", runs())
+	}
+}
@@ -0,0 +1,349 @@
+package cloudh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns"
+	"github.com/go-acme/lego/v4/providers/dns/hetzner"
+)
+
+// tlsDnsStaleAge is age after which TXT records are treated as left behind, younger
+// records may belong to another certificate with the same name being ordered.
+const tlsDnsStaleAge = time.Hour
+
+// TlsDnsOptions tune DNS-01 propagation check, zero values keep lego/provider defaults.
+type TlsDnsOptions struct {
+	// Resolvers are recursive nameservers (host[:port]) used for propagation check.
+	Resolvers          []string
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+	// TTL of challenge records created by Hetzner provider, other providers
+	// read TTL from their own environment variable (e.g. CLOUDFLARE_TTL).
+	TTL int
+	// SkipNsCheck accepts the record once every recursive resolver (Resolvers,
+	// resolv.conf otherwise) returns the expected value, authoritative
+	// nameservers are not queried.
+	SkipNsCheck bool
+	// Delay waits after successful propagation check before validation.
+	Delay time.Duration
+}
+
+// tlsDnsProvider tracks presented records in storage, so TXT records
+// left behind by failed runs are cleaned up on the next run.
+type tlsDnsProvider struct {
+	challenge.Provider
+	at *AutoTls
+
+	mu        sync.Mutex
+	presented map[string]bool
+}
+
+type tlsDnsRecord struct {
+	Domain  string    `json:"domain"`
+	Token   string    `json:"token"`
+	KeyAuth string    `json:"key_auth"`
+	Created time.Time `json:"created"`
+}
+
+// tlsDnsRouter dispatches DNS-01 challenges to providers by domain pattern
+// (see tlsDnsMatch), longest pattern wins, fallback is used for unmatched domains.
+type tlsDnsRouter struct {
+	patterns  []string
+	providers map[string]challenge.Provider
+	fallback  challenge.Provider
+}
+
+// dnsProvider creates lego DNS provider by name, hetzner uses DnsToken
+// (HETZNER_API_KEY otherwise) and Dns.TTL. Other providers read credentials and TTL
+// from environment, Dns.TTL is ignored with a warning.
+func (at *AutoTls) dnsProvider(name string) (challenge.Provider, error) {
+	if name == "" || name == "hetzner" {
+		hc := hetzner.NewDefaultConfig()
+		hc.APIKey = at.Config.DnsToken
+		if hc.APIKey == "" {
+			hc.APIKey = os.Getenv("HETZNER_API_KEY")
+		}
+		if at.Config.Dns.TTL > 0 {
+			hc.TTL = at.Config.Dns.TTL
+		}
+		return hetzner.NewDNSProviderConfig(hc)
+	}
+
+	if at.Config.Dns.TTL > 0 {
+		log.Printf("DNS provider %s ignores dns-ttl, set TTL in its environment variables", name)
+	}
+	provider, err := dns.NewDNSChallengeProviderByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("DNS provider %s: %w", name, err)
+	}
+	return provider, nil
+}
+
+// dnsChallengeProvider returns provider for Config.DnsProvider or a router
+// when per-domain providers are configured in Config.DnsProviders.
+func (at *AutoTls) dnsChallengeProvider() (challenge.Provider, error) {
+	byName := make(map[string]challenge.Provider)
+	var fallback challenge.Provider
+	if name := at.dnsFallbackName(); name != "" {
+		provider, err := at.dnsProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		byName[name], fallback = provider, provider
+	}
+	if len(at.Config.DnsProviders) == 0 {
+		return fallback, nil
+	}
+
+	router := &tlsDnsRouter{
+		patterns:  make([]string, 0, len(at.Config.DnsProviders)),
+		providers: make(map[string]challenge.Provider, len(at.Config.DnsProviders)),
+		fallback:  fallback,
+	}
+	for pattern, name := range at.Config.DnsProviders {
+		provider, ok := byName[name]
+		if !ok {
+			var err error
+			if provider, err = at.dnsProvider(name); err != nil {
+				return nil, err
+			}
+			byName[name] = provider
+		}
+
+		pattern = strings.ToLower(pattern)
+		router.patterns = append(router.patterns, pattern)
+		router.providers[pattern] = provider
+	}
+	sort.Slice(router.patterns, func(i, j int) bool {
+		return len(router.patterns[i]) > len(router.patterns[j])
+	})
+
+	return router, nil
+}
+
+// dnsFallbackName returns provider of domains not matched by Config.DnsProviders,
+// empty when every domain has to be mapped (no token nor dns provider given).
+func (at *AutoTls) dnsFallbackName() string {
+	switch {
+	case at.Config.DnsProvider != "":
+		return at.Config.DnsProvider
+	case at.Config.DnsToken != "" || len(at.Config.DnsProviders) == 0:
+		return "hetzner"
+	}
+	return ""
+}
+
+// dnsProviderName returns DNS provider routed for domain (see dnsChallengeProvider),
+// empty when no provider matches.
+func (at *AutoTls) dnsProviderName(domain string) string {
+	name, longest := at.dnsFallbackName(), 0
+	for pattern, provider := range at.Config.DnsProviders {
+		if tlsDnsMatch(pattern, domain) && len(pattern) > longest {
+			name, longest = provider, len(pattern)
+		}
+	}
+	return name
+}
+
+// tlsDnsMatch reports whether domain is matched by dns-map pattern:
+// a.com matches a.com and its subdomains, *.a.com matches subdomains only
+// (and wildcard *.a.com itself, its record lives in the same zone).
+func tlsDnsMatch(pattern, domain string) bool {
+	pattern, domain = strings.ToLower(pattern), strings.ToLower(domain)
+	wildcard := strings.HasPrefix(domain, "*.")
+	domain = strings.TrimPrefix(domain, "*.")
+
+	if suffix := strings.TrimPrefix(pattern, "*."); suffix != pattern {
+		return strings.HasSuffix(domain, "."+suffix) || wildcard && domain == suffix
+	}
+	return domain == pattern || strings.HasSuffix(domain, "."+pattern)
+}
+
+func (at *AutoTls) setupDnsChallenge(client *lego.Client) error {
+	provider, err := at.dnsChallengeProvider()
+	if err != nil {
+		return err
+	}
+
+	opts := []dns01.ChallengeOption{
+		dns01.CondOption(len(at.Config.Dns.Resolvers) > 0,
+			dns01.AddRecursiveNameservers(dns01.ParseNameservers(at.Config.Dns.Resolvers))),
+	}
+	opts = append(opts, dns01.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+		if err := at.ctx().Err(); err != nil {
+			return false, err
+		}
+		// lego's own option skips the check entirely once resolvers answer at all
+		if at.Config.Dns.SkipNsCheck {
+			check = func(fqdn, value string) (bool, error) {
+				return lookupTxt(fqdn, value, at.dnsResolvers())
+			}
+		}
+		ok, err := check(fqdn, value)
+		if delay := at.Config.Dns.Delay; ok && err == nil && delay > 0 {
+			log.Printf("[%s] Record propagated, waiting %s before validation", domain, delay)
+			if !sleepContext(at.ctx(), delay) {
+				return false, at.ctx().Err()
+			}
+		}
+		return ok, err
+	}))
+
+	return client.Challenge.SetDNS01Provider(&tlsDnsProvider{
+		Provider:  provider,
+		at:        at,
+		presented: make(map[string]bool),
+	}, opts...)
+}
+
+func (p *tlsDnsProvider) Present(domain, token, keyAuth string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cleanStale(domain)
+
+	b, err := json.Marshal(tlsDnsRecord{Domain: domain, Token: token, KeyAuth: keyAuth, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err = p.at.Storage.Write(context.TODO(), p.key(token), b); err != nil {
+		return err
+	}
+	if err = p.Provider.Present(domain, token, keyAuth); err != nil {
+		p.at.Storage.Delete(context.TODO(), p.key(token))
+		return err
+	}
+	p.presented[token] = true
+	return nil
+}
+
+func (p *tlsDnsProvider) CleanUp(domain, token, keyAuth string) error {
+	if err := p.Provider.CleanUp(domain, token, keyAuth); err != nil {
+		return err
+	}
+	return p.at.Storage.Delete(context.TODO(), p.key(token))
+}
+
+// Timeout returns configured propagation timeout/interval, provider's otherwise.
+func (p *tlsDnsProvider) Timeout() (time.Duration, time.Duration) {
+	timeout, interval := dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	if pt, ok := p.Provider.(challenge.ProviderTimeout); ok {
+		timeout, interval = pt.Timeout()
+	}
+	if p.at.Config.Dns.PropagationTimeout > 0 {
+		timeout = p.at.Config.Dns.PropagationTimeout
+	}
+	if p.at.Config.Dns.PollingInterval > 0 {
+		interval = p.at.Config.Dns.PollingInterval
+	}
+	return timeout, interval
+}
+
+// cleanStale removes records older than tlsDnsStaleAge. Records are not owned
+// by the locked domain (a.com and *.a.com share _acme-challenge.a.com),
+// so younger ones are left alone. Failures are logged only, records are kept
+// for the next attempt.
+func (p *tlsDnsProvider) cleanStale(domain string) {
+	keys, err := p.at.Storage.Find(context.TODO(), TlsChallengeKey(p.at.challengePathPrefix(), TlsChallengeDns01, ""), ".json")
+	if err != nil {
+		log.Printf("[%s] Listing DNS records failed: %v", domain, err)
+		return
+	}
+	for _, key := range keys {
+		b, err := p.at.Storage.Read(context.TODO(), key)
+		if err != nil {
+			log.Printf("[%s] Reading %s failed: %v", domain, key, err)
+			continue
+		}
+		var rec tlsDnsRecord
+		if err = json.Unmarshal(b, &rec); err != nil {
+			log.Printf("[%s] Invalid DNS record %s: %v", domain, key, err)
+			continue
+		}
+		if p.presented[rec.Token] || !rec.stale() {
+			continue
+		}
+
+		log.Printf("[%s] Cleaning up stale DNS record left since %s", rec.Domain, rec.Created.Format(time.RFC3339))
+		if err = p.Provider.CleanUp(rec.Domain, rec.Token, rec.KeyAuth); err != nil {
+			log.Printf("[%s] Stale DNS record cleanup failed: %v", rec.Domain, err)
+			continue
+		}
+		if err = p.at.Storage.Delete(context.TODO(), key); err != nil {
+			log.Printf("[%s] Deleting %s failed: %v", rec.Domain, key, err)
+		}
+	}
+}
+
+// stale reports whether record was left behind by a failed run.
+func (rec *tlsDnsRecord) stale() bool {
+	return time.Since(rec.Created) >= tlsDnsStaleAge
+}
+
+func (p *tlsDnsProvider) key(token string) string {
+	return TlsChallengeKey(p.at.challengePathPrefix(), TlsChallengeDns01, token+".json")
+}
+
+func (r *tlsDnsRouter) Present(domain, token, keyAuth string) error {
+	provider, err := r.provider(domain)
+	if err != nil {
+		return err
+	}
+	return provider.Present(domain, token, keyAuth)
+}
+
+func (r *tlsDnsRouter) CleanUp(domain, token, keyAuth string) error {
+	provider, err := r.provider(domain)
+	if err != nil {
+		return err
+	}
+	return provider.CleanUp(domain, token, keyAuth)
+}
+
+// Timeout returns the longest timeout/interval of routed providers.
+func (r *tlsDnsRouter) Timeout() (time.Duration, time.Duration) {
+	timeout, interval := 60*time.Second, 2*time.Second
+	for _, p := range append(r.all(), r.fallback) {
+		if pt, ok := p.(challenge.ProviderTimeout); ok {
+			t, i := pt.Timeout()
+			if t > timeout {
+				timeout = t
+			}
+			if i > interval {
+				interval = i
+			}
+		}
+	}
+	return timeout, interval
+}
+
+func (r *tlsDnsRouter) provider(domain string) (challenge.Provider, error) {
+	for _, pattern := range r.patterns {
+		if tlsDnsMatch(pattern, domain) {
+			return r.providers[pattern], nil
+		}
+	}
+	if r.fallback == nil {
+		return nil, fmt.Errorf("[%s] No DNS provider matches domain, add it to dns-map or set dns-provider", domain)
+	}
+	return r.fallback, nil
+}
+
+func (r *tlsDnsRouter) all() []challenge.Provider {
+	res := make([]challenge.Provider, 0, len(r.providers))
+	for _, p := range r.providers {
+		res = append(res, p)
+	}
+	return res
+}
@@ -0,0 +1,198 @@
+package cloudh
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/miekg/dns"
+)
+
+type testDnsProvider struct {
+	name string
+}
+
+func (p *testDnsProvider) Present(domain, token, keyAuth string) error { return nil }
+func (p *testDnsProvider) CleanUp(domain, token, keyAuth string) error { return nil }
+
+func TestTlsDnsRouterProvider(t *testing.T) {
+	a := &testDnsProvider{name: "a"}
+	wildcardA := &testDnsProvider{name: "*.a"}
+	sub := &testDnsProvider{name: "sub.a"}
+	fallback := &testDnsProvider{name: "fallback"}
+
+	router := &tlsDnsRouter{
+		patterns: []string{"*.sub.a.com", "*.a.com", "b.net"},
+		providers: map[string]challenge.Provider{
+			"*.sub.a.com": sub,
+			"*.a.com":     wildcardA,
+			"b.net":       a,
+		},
+		fallback: fallback,
+	}
+
+	tests := []struct {
+		domain string
+		want   *testDnsProvider
+	}{
+		{domain: "a.com", want: fallback},
+		{domain: "*.a.com", want: wildcardA},
+		{domain: "www.a.com", want: wildcardA},
+		{domain: "WWW.A.COM", want: wildcardA},
+		{domain: "sub.a.com", want: wildcardA},
+		{domain: "x.sub.a.com", want: sub},
+		{domain: "*.sub.a.com", want: sub},
+		{domain: "b.net", want: a},
+		{domain: "*.b.net", want: a},
+		{domain: "x.y.b.net", want: a},
+		{domain: "notb.net", want: fallback},
+		{domain: "c.org", want: fallback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got, err := router.provider(tt.domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("provider(%s) = %s, want %s", tt.domain, got.(*testDnsProvider).name, tt.want.name)
+			}
+		})
+	}
+
+	router.fallback = nil
+	if _, err := router.provider("c.org"); err == nil {
+		t.Error("provider(c.org) without fallback succeeded, want error")
+	}
+}
+
+func TestDnsProviderName(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TlsConfig
+		domain string
+		want   string
+	}{
+		{name: "default", config: TlsConfig{}, domain: "a.com", want: "hetzner"},
+		{name: "provider", config: TlsConfig{DnsProvider: "cloudflare"}, domain: "a.com", want: "cloudflare"},
+		{
+			name:   "mapped",
+			config: TlsConfig{DnsProvider: "cloudflare", DnsProviders: map[string]string{"*.a.com": "route53"}},
+			domain: "www.a.com",
+			want:   "route53",
+		},
+		{
+			name:   "wildcard pattern skips apex",
+			config: TlsConfig{DnsProvider: "cloudflare", DnsProviders: map[string]string{"*.a.com": "route53"}},
+			domain: "a.com",
+			want:   "cloudflare",
+		},
+		{
+			name:   "longest pattern wins",
+			config: TlsConfig{DnsProviders: map[string]string{"a.com": "route53", "*.sub.a.com": "gcloud"}},
+			domain: "x.sub.a.com",
+			want:   "gcloud",
+		},
+		{
+			name:   "token fallback",
+			config: TlsConfig{DnsToken: "t", DnsProviders: map[string]string{"a.com": "route53"}},
+			domain: "b.net",
+			want:   "hetzner",
+		},
+		{
+			name:   "map only",
+			config: TlsConfig{DnsProviders: map[string]string{"a.com": "route53"}},
+			domain: "b.net",
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := &AutoTls{Config: tt.config}
+			if got := at.dnsProviderName(tt.domain); got != tt.want {
+				t.Errorf("dnsProviderName(%s) = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+// testDnsServer answers TXT queries from records (fqdn -> values), NXDOMAIN otherwise.
+func testDnsServer(t *testing.T, records map[string][]string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		values, ok := records[r.Question[0].Name]
+		if !ok {
+			m.Rcode = dns.RcodeNameError
+		}
+		for _, v := range values {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{v},
+			})
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestLookupTxt(t *testing.T) {
+	fresh := testDnsServer(t, map[string][]string{"_acme-challenge.a.com.": {"old", "value"}})
+	stale := testDnsServer(t, map[string][]string{"_acme-challenge.a.com.": {"old"}})
+
+	tests := []struct {
+		name        string
+		fqdn        string
+		nameservers []string
+		want        bool
+	}{
+		{name: "propagated", fqdn: "_acme-challenge.a.com.", nameservers: []string{fresh}, want: true},
+		{name: "stale value", fqdn: "_acme-challenge.a.com.", nameservers: []string{stale}},
+		{name: "one resolver is stale", fqdn: "_acme-challenge.a.com.", nameservers: []string{fresh, stale}},
+		{name: "missing record", fqdn: "_acme-challenge.b.com.", nameservers: []string{fresh}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupTxt(tt.fqdn, "value", tt.nameservers)
+			if got != tt.want || (err == nil) != tt.want {
+				t.Errorf("lookupTxt() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTlsDnsProviderCleanStale(t *testing.T) {
+	at := &AutoTls{Config: TlsConfig{CertPathPrefix: t.TempDir()}, Storage: &TlsFileStorage{}}
+	p := &tlsDnsProvider{Provider: &testDnsProvider{}, at: at, presented: make(map[string]bool)}
+	records := map[string]tlsDnsRecord{
+		"same":  {Domain: "a.com", Token: "same", Created: time.Now()},
+		"other": {Domain: "b.com", Token: "other", Created: time.Now()},
+		"old":   {Domain: "a.com", Token: "old", Created: time.Now().Add(-2 * tlsDnsStaleAge)},
+	}
+	for token, rec := range records {
+		b, _ := json.Marshal(rec)
+		if err := at.Storage.Write(context.Background(), p.key(token), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Present("a.com", "new", "auth"); err != nil {
+		t.Fatal(err)
+	}
+	// fresh record of a.com may be presented by *.a.com order running elsewhere
+	for token, want := range map[string]bool{"same": true, "other": true, "old": false, "new": true} {
+		if ok, _ := at.Storage.Exists(context.Background(), p.key(token)); ok != want {
+			t.Errorf("record %s kept = %v, want %v", token, ok, want)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package cloudh
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// sealed values start with one of these prefixes, anything else is plaintext;
+// v3 binds the value to its key relative to the storage prefix (AAD),
+// v2 (bound to the full key) and v1 values are still readable
+var (
+	tlsSealedPrefixV1 = []byte("owlenc:v1:")
+	tlsSealedPrefixV2 = []byte("owlenc:v2:")
+	tlsSealedPrefix   = []byte("owlenc:v3:")
+)
+
+// ErrTlsNotSealed is returned by TlsOpen when value was not sealed by TlsSeal.
+var ErrTlsNotSealed = errors.New("Value is not encrypted")
+
+// TlsKeyWrapper wraps and unwraps data encryption keys (envelope encryption).
+type TlsKeyWrapper interface {
+	WrapKey(ctx context.Context, dek []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// TlsEncryptedStorage seals values written to Storage with AES-256-GCM using
+// a random data key per value, the data key is stored next to the value
+// wrapped by Wrapper. Values are bound to their file name (domain and extension),
+// so a sealed value copied under another name fails to decrypt while moving
+// the whole prefix (e.g. migrate to another path) keeps it readable. Plaintext values are returned as is
+// unless Strict is set.
+type TlsEncryptedStorage struct {
+	Storage TlsStorage
+	Wrapper TlsKeyWrapper
+	Strict  bool
+}
+
+// TlsFileKeyWrapper wraps data keys with a local AES-256 key.
+type TlsFileKeyWrapper struct {
+	Key []byte
+}
+
+// TlsTransitKeyWrapper wraps data keys using Vault's transit engine.
+type TlsTransitKeyWrapper struct {
+	Logical *vaultapi.Logical
+	Mount   string
+	KeyName string
+}
+
+// NewTlsFileKeyWrapper loads key from path, the file must contain
+// 32 raw bytes or their base64 encoding.
+func NewTlsFileKeyWrapper(path string) (*TlsFileKeyWrapper, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		b, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("Key file %s must contain 32 bytes (raw or base64)", path)
+		}
+	}
+	return &TlsFileKeyWrapper{Key: b}, nil
+}
+
+// ----- TlsEncryptedStorage -----
+
+func (es *TlsEncryptedStorage) Exists(ctx context.Context, key string) (bool, error) {
+	return es.Storage.Exists(ctx, key)
+}
+
+func (es *TlsEncryptedStorage) Write(ctx context.Context, key string, b []byte) error {
+	sealed, err := TlsSeal(ctx, es.Wrapper, b, tlsSealAad(key))
+	if err != nil {
+		return err
+	}
+	return es.Storage.Write(ctx, key, sealed)
+}
+
+func (es *TlsEncryptedStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	b, err := es.Storage.Read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !es.Strict && !TlsSealed(b) {
+		return b, nil
+	}
+	aad := tlsSealAad(key)
+	if bytes.HasPrefix(b, tlsSealedPrefixV2) {
+		aad = []byte(key)
+	}
+	b, err = TlsOpen(ctx, es.Wrapper, b, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
+
+func (es *TlsEncryptedStorage) Find(ctx context.Context, key string, ext string) ([]string, error) {
+	return es.Storage.Find(ctx, key, ext)
+}
+
+func (es *TlsEncryptedStorage) Delete(ctx context.Context, key string) error {
+	return es.Storage.Delete(ctx, key)
+}
+
+func (es *TlsEncryptedStorage) WriteBundle(ctx context.Context, stem string, files map[string][]byte) error {
+	sealed := make(map[string][]byte, len(files))
+	for ext, b := range files {
+		if b == nil {
+			sealed[ext] = nil
+			continue
+		}
+		s, err := TlsSeal(ctx, es.Wrapper, b, tlsSealAad(stem+ext))
+		if err != nil {
+			return err
+		}
+		sealed[ext] = s
+	}
+
+	if bs, ok := es.Storage.(TlsBundleStorage); ok {
+		return bs.WriteBundle(ctx, stem, sealed)
+	}
+	for ext, b := range sealed {
+		if b == nil {
+			if err := es.Storage.Delete(ctx, stem+ext); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := es.Storage.Write(ctx, stem+ext, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *TlsEncryptedStorage) Lock(ctx context.Context, key string, wait bool) (func() error, error) {
+	if locker, ok := es.Storage.(TlsLocker); ok {
+		return locker.Lock(ctx, key, wait)
+	}
+	return nil, ErrTlsLockUnsupported
+}
+
+// TlsSeal encrypts b with a random data key wrapped by w, aad (e.g. storage key)
+// is authenticated but not stored, TlsOpen must be given the same aad.
+// Output: prefix + base64(wrapped data key) + ":" + base64(nonce + ciphertext)
+func TlsSeal(ctx context.Context, w TlsKeyWrapper, b []byte, aad []byte) ([]byte, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, err
+	}
+	ciphertext, err := aesGcmSeal(dek, b, aad)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := w.WrapKey(ctx, dek)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(tlsSealedPrefix)
+	buf.WriteString(base64.StdEncoding.EncodeToString(wrapped))
+	buf.WriteString(":")
+	buf.WriteString(base64.StdEncoding.EncodeToString(ciphertext))
+	return buf.Bytes(), nil
+}
+
+// TlsOpen decrypts value sealed by TlsSeal with the same aad,
+// ErrTlsNotSealed is returned for other values.
+func TlsOpen(ctx context.Context, w TlsKeyWrapper, b []byte, aad []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(b, tlsSealedPrefix):
+		b = bytes.TrimPrefix(b, tlsSealedPrefix)
+	case bytes.HasPrefix(b, tlsSealedPrefixV2):
+		b = bytes.TrimPrefix(b, tlsSealedPrefixV2)
+	case bytes.HasPrefix(b, tlsSealedPrefixV1):
+		b, aad = bytes.TrimPrefix(b, tlsSealedPrefixV1), nil
+	default:
+		return nil, ErrTlsNotSealed
+	}
+
+	parts := bytes.SplitN(b, []byte(":"), 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed encrypted value")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := w.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unwrap data key: %w", err)
+	}
+	return aesGcmOpen(dek, ciphertext, aad)
+}
+
+// TlsSealed reports whether b was sealed by TlsSeal.
+func TlsSealed(b []byte) bool {
+	return bytes.HasPrefix(b, tlsSealedPrefix) || bytes.HasPrefix(b, tlsSealedPrefixV2) || bytes.HasPrefix(b, tlsSealedPrefixV1)
+}
+
+// tlsSealAad is storage key relative to its prefix, certificate and account
+// files are kept directly under the prefix so that is the file name.
+func tlsSealAad(key string) []byte {
+	return []byte(path.Base(filepath.ToSlash(key)))
+}
+
+// ----- TlsFileKeyWrapper -----
+
+func (w *TlsFileKeyWrapper) WrapKey(ctx context.Context, dek []byte) ([]byte, error) {
+	return aesGcmSeal(w.Key, dek, nil)
+}
+
+func (w *TlsFileKeyWrapper) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return aesGcmOpen(w.Key, wrapped, nil)
+}
+
+// ----- TlsTransitKeyWrapper -----
+
+func (w *TlsTransitKeyWrapper) WrapKey(ctx context.Context, dek []byte) ([]byte, error) {
+	secret, err := w.Logical.Write(path.Join(w.Mount, "encrypt", w.KeyName), map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(dek),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("Empty transit encrypt response")
+	}
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return nil, errors.New("Missing ciphertext in transit encrypt response")
+	}
+	return []byte(ciphertext), nil
+}
+
+func (w *TlsTransitKeyWrapper) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	secret, err := w.Logical.Write(path.Join(w.Mount, "decrypt", w.KeyName), map[string]interface{}{
+		"ciphertext": string(wrapped),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("Empty transit decrypt response")
+	}
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, errors.New("Missing plaintext in transit decrypt response")
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+// -----
+
+func aesGcmSeal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func aesGcmOpen(key, ciphertext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("Ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
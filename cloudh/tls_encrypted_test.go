@@ -0,0 +1,187 @@
+package cloudh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestTlsSealOpen(t *testing.T) {
+	w := &TlsFileKeyWrapper{Key: bytes.Repeat([]byte{1}, 32)}
+	other := &TlsFileKeyWrapper{Key: bytes.Repeat([]byte{2}, 32)}
+
+	sealed, err := TlsSeal(context.Background(), w, []byte("secret"), []byte("certs/a.com.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !TlsSealed(sealed) {
+		t.Fatalf("TlsSealed(%q) = false", sealed)
+	}
+
+	tests := []struct {
+		name    string
+		wrapper TlsKeyWrapper
+		b       []byte
+		aad     string
+		want    string
+		err     bool
+	}{
+		{name: "same key", wrapper: w, b: sealed, aad: "certs/a.com.key", want: "secret"},
+		{name: "other storage key", wrapper: w, b: sealed, aad: "certs/b.com.key", err: true},
+		{name: "other wrapper", wrapper: other, b: sealed, aad: "certs/a.com.key", err: true},
+		{name: "plaintext", wrapper: w, b: []byte("secret"), aad: "certs/a.com.key", err: true},
+		{name: "malformed", wrapper: w, b: []byte("owlenc:v2:abc"), aad: "certs/a.com.key", err: true},
+		{name: "tampered", wrapper: w, b: append(append([]byte{}, sealed[:len(sealed)-4]...), "AAAA"...), aad: "certs/a.com.key", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TlsOpen(context.Background(), tt.wrapper, tt.b, []byte(tt.aad))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("TlsOpen() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("TlsOpen() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTlsOpenV1(t *testing.T) {
+	w := &TlsFileKeyWrapper{Key: bytes.Repeat([]byte{1}, 32)}
+
+	sealed, err := TlsSeal(context.Background(), w, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := append(append([]byte{}, tlsSealedPrefixV1...), bytes.TrimPrefix(sealed, tlsSealedPrefix)...)
+
+	got, err := TlsOpen(context.Background(), w, v1, []byte("ignored for v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "secret" {
+		t.Errorf("TlsOpen() = %q, want %q", got, "secret")
+	}
+}
+
+func TestTlsEncryptedStorage(t *testing.T) {
+	dir := t.TempDir()
+	w := &TlsFileKeyWrapper{Key: bytes.Repeat([]byte{1}, 32)}
+	raw := &TlsFileStorage{}
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		strict bool
+		setup  func(es *TlsEncryptedStorage, key string) error
+		want   string
+		err    error
+	}{
+		{
+			name: "sealed",
+			setup: func(es *TlsEncryptedStorage, key string) error {
+				return es.Write(ctx, key, []byte("secret"))
+			},
+			want: "secret",
+		},
+		{
+			name: "plaintext",
+			setup: func(es *TlsEncryptedStorage, key string) error {
+				return raw.Write(ctx, key, []byte("secret"))
+			},
+			want: "secret",
+		},
+		{
+			name:   "plaintext strict",
+			strict: true,
+			setup: func(es *TlsEncryptedStorage, key string) error {
+				return raw.Write(ctx, key, []byte("secret"))
+			},
+			err: ErrTlsNotSealed,
+		},
+		{
+			name: "copied from other key",
+			setup: func(es *TlsEncryptedStorage, key string) error {
+				if err := es.Write(ctx, key+".orig", []byte("secret")); err != nil {
+					return err
+				}
+				b, err := raw.Read(ctx, key+".orig")
+				if err != nil {
+					return err
+				}
+				return raw.Write(ctx, key, b)
+			},
+			err: errors.New("any"),
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := &TlsEncryptedStorage{Storage: raw, Wrapper: w, Strict: tt.strict}
+			key := dir + "/" + string(rune('a'+i)) + ".key"
+			if err := tt.setup(es, key); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := es.Read(ctx, key)
+			switch {
+			case tt.err != nil && err == nil:
+				t.Fatalf("Read() = %q, want error", got)
+			case tt.err == ErrTlsNotSealed && !errors.Is(err, ErrTlsNotSealed):
+				t.Fatalf("Read() error = %v, want %v", err, ErrTlsNotSealed)
+			case tt.err == nil && err != nil:
+				t.Fatal(err)
+			case tt.err == nil && string(got) != tt.want:
+				t.Errorf("Read() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTlsEncryptedStorageMovedPrefix(t *testing.T) {
+	w := &TlsFileKeyWrapper{Key: bytes.Repeat([]byte{1}, 32)}
+	raw := &TlsFileStorage{}
+	es := &TlsEncryptedStorage{Storage: raw, Wrapper: w, Strict: true}
+	ctx := context.Background()
+	from, to := filepath.Join(t.TempDir(), "tls"), filepath.Join(t.TempDir(), "certs")
+
+	if err := es.Write(ctx, filepath.Join(from, "a.com.key"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := TlsSeal(ctx, w, []byte("secret"), []byte(filepath.Join(to, "b.com.key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 = append(append([]byte{}, tlsSealedPrefixV2...), bytes.TrimPrefix(v2, tlsSealedPrefix)...)
+	if err = raw.Write(ctx, filepath.Join(to, "b.com.key"), v2); err != nil {
+		t.Fatal(err)
+	}
+	// copied as is, e.g. by migrate without encryption settings
+	b, err := raw.Read(ctx, filepath.Join(from, "a.com.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.Write(ctx, filepath.Join(to, "a.com.key"), b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a.com.key", "b.com.key"} {
+		got, err := es.Read(ctx, filepath.Join(to, key))
+		if err != nil || string(got) != "secret" {
+			t.Errorf("Read(%s) = %q, %v, want secret", key, got, err)
+		}
+	}
+	if err = raw.Write(ctx, filepath.Join(to, "c.com.key"), b); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := es.Read(ctx, filepath.Join(to, "c.com.key")); err == nil {
+		t.Errorf("Read(c.com.key) = %q, want error for value sealed as a.com.key", got)
+	}
+}
@@ -0,0 +1,122 @@
+package cloudh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTlsFileStoragePerm(t *testing.T) {
+	tests := []struct {
+		name  string
+		perms map[string]TlsFilePerm
+		file  string
+		want  TlsFilePerm
+	}{
+		{name: "certificate", file: "/etc/owl/a.com.crt", want: TlsFilePerm{Mode: 0o644, Uid: -1, Gid: -1}},
+		{name: "key", file: "/etc/owl/a.com.key", want: TlsFilePerm{Mode: 0o600, Uid: -1, Gid: -1}},
+		{name: "order", file: "/etc/owl/a.com.order", want: TlsFilePerm{Mode: 0o600, Uid: -1, Gid: -1}},
+		{name: "staged account key", file: "/etc/owl/acc/abc.next.key", want: TlsFilePerm{Mode: 0o600, Uid: -1, Gid: -1}},
+		{name: "archived key", file: "/etc/owl/a.com.key.revoked-20200101", want: TlsFilePerm{Mode: 0o600, Uid: -1, Gid: -1}},
+		{
+			name:  "default override",
+			perms: map[string]TlsFilePerm{"": {Mode: 0o640, Uid: -1, Gid: 10}},
+			file:  "/etc/owl/a.com.crt",
+			want:  TlsFilePerm{Mode: 0o640, Uid: -1, Gid: 10},
+		},
+		{
+			name: "extension overrides default",
+			perms: map[string]TlsFilePerm{
+				"":     {Mode: 0o640, Uid: 5, Gid: 10},
+				".key": {Mode: 0o400, Uid: -1, Gid: 20},
+			},
+			file: "/etc/owl/a.com.key",
+			want: TlsFilePerm{Mode: 0o400, Uid: 5, Gid: 20},
+		},
+		{
+			name:  "zero mode keeps default",
+			perms: map[string]TlsFilePerm{".key": {Uid: 1, Gid: -1}},
+			file:  "/etc/owl/a.com.key",
+			want:  TlsFilePerm{Mode: 0o600, Uid: 1, Gid: -1},
+		},
+		{
+			name:  "other extension is not affected",
+			perms: map[string]TlsFilePerm{".key": {Mode: os.FileMode(0o400), Uid: -1, Gid: -1}},
+			file:  "/etc/owl/a.com.ca",
+			want:  TlsFilePerm{Mode: 0o644, Uid: -1, Gid: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &TlsFileStorage{Perms: tt.perms}
+			if got := fs.perm(tt.file); got != tt.want {
+				t.Errorf("perm(%s) = %+v, want %+v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTlsFileStorageWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fs := &TlsFileStorage{Perms: map[string]TlsFilePerm{".ca": {Mode: 0o640, Uid: -1, Gid: -1}}}
+
+	tests := []struct {
+		file string
+		mode os.FileMode
+	}{
+		{file: "a.com.crt", mode: 0o644},
+		{file: "a.com.key", mode: 0o600},
+		{file: "a.com.ca", mode: 0o640},
+		{file: "nested/b.com.key", mode: 0o600},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.file)
+		// overwritten file gets configured mode as well
+		for _, content := range []string{"first", "second"} {
+			if err := fs.Write(ctx, name, []byte(content)); err != nil {
+				t.Fatalf("Write(%s) = %v", tt.file, err)
+			}
+			if b, err := fs.Read(ctx, name); err != nil || string(b) != content {
+				t.Errorf("Read(%s) = %q, %v, want %q", tt.file, b, err, content)
+			}
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != tt.mode {
+				t.Errorf("%s mode = %o, want %o", tt.file, fi.Mode().Perm(), tt.mode)
+			}
+			if err = os.Chmod(name, 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// write through symlink replaces target, link stays
+	target := filepath.Join(dir, "target.crt")
+	link := filepath.Join(dir, "link.crt")
+	if err := ioutil.WriteFile(target, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Write(ctx, link, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link.crt = %v, %v, want symlink", fi, err)
+	}
+	if b, _ := ioutil.ReadFile(target); string(b) != "new" {
+		t.Errorf("target.crt = %q, want new", b)
+	}
+
+	// temporary files don't stay behind
+	leftovers, err := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+	if err != nil || len(leftovers) != 0 {
+		t.Errorf("temporary files = %v, %v", leftovers, err)
+	}
+}
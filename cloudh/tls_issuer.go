@@ -0,0 +1,298 @@
+package cloudh
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/resolver"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/platform/wait"
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// Issuers selectable by issuer= arg.
+const (
+	TlsIssuerAcme     = "acme"
+	TlsIssuerVaultPki = "vault-pki"
+)
+
+// TlsIssuer signs certificates for AutoTls.Issue/Renew.
+type TlsIssuer interface {
+	// Obtain returns certificate for domains (first one is the common name) signed for privateKey.
+	Obtain(domains []string, privateKey crypto.PrivateKey) (*certificate.Resource, error)
+	// ObtainForCSR returns certificate for caller supplied CSR (PrivateKey is left empty).
+	ObtainForCSR(csr *x509.CertificateRequest) (*certificate.Resource, error)
+	// Annotate adds issuer details to certificate metadata.
+	Annotate(meta *TlsCertMeta)
+}
+
+// tlsOrderIssuer is implemented by issuers whose orders outlive the process (ACME),
+// obtain resumes order interrupted by a crash instead of placing a new one.
+type tlsOrderIssuer interface {
+	// ObtainOrder is Obtain continuing order at url when it is still pending or ready,
+	// placed is called with URL of a new order before its challenges are solved.
+	ObtainOrder(url string, domains []string, privateKey crypto.PrivateKey, placed func(url string) error) (*certificate.Resource, error)
+}
+
+// issuer returns AutoTls.Issuer or sets up ACME client,
+// account is registered when missing and register is set.
+func (at *AutoTls) issuer(register bool) (TlsIssuer, error) {
+	if at.Issuer != nil {
+		return at.Issuer, nil
+	}
+
+	user, client, err := at.setup()
+	if err != nil {
+		return nil, err
+	}
+	if user.Registration == nil {
+		if !register {
+			return nil, fmt.Errorf("Account is not registered. Issue new certificate.")
+		}
+		if user.Registration, err = at.register(client); err != nil {
+			return nil, err
+		}
+		if err = at.saveAccount(user); err != nil {
+			return nil, err
+		}
+	}
+	return &tlsAcmeIssuer{at: at, client: client, user: user}, nil
+}
+
+// ----- ACME -----
+
+// tlsAcmeStatusReady is status of order with all authorizations valid (RFC 8555 7.1.6).
+const tlsAcmeStatusReady = "ready"
+
+type tlsAcmeIssuer struct {
+	at     *AutoTls
+	client *lego.Client
+	user   *AcmeUser
+}
+
+func (i *tlsAcmeIssuer) Obtain(domains []string, privateKey crypto.PrivateKey) (*certificate.Resource, error) {
+	return i.ObtainOrder("", domains, privateKey, func(string) error { return nil })
+}
+
+func (i *tlsAcmeIssuer) ObtainOrder(url string, domains []string, privateKey crypto.PrivateKey, placed func(url string) error) (*certificate.Resource, error) {
+	config, err := i.at.legoConfig(i.user)
+	if err != nil {
+		return nil, err
+	}
+	core, err := api.New(config.HTTPClient, config.UserAgent, config.CADirURL, i.user.Registration.URI, i.user.key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create client: %w", err)
+	}
+
+	var order acme.ExtendedOrder
+	if url != "" {
+		if order, err = core.Orders.Get(url); err != nil {
+			log.Printf("[%s] Order %s cannot be resumed: %v", domains[0], url, err)
+			url = ""
+		} else if order.Status != acme.StatusPending && order.Status != tlsAcmeStatusReady {
+			log.Printf("[%s] Order %s is %s, placing new order", domains[0], url, order.Status)
+			url = ""
+		} else {
+			log.Printf("[%s] acme: Resuming %s order %s", domains[0], order.Status, url)
+			order.Location = url
+		}
+	}
+	if url == "" {
+		if order, err = core.Orders.New(domains); err != nil {
+			return nil, err
+		}
+		if err = placed(order.Location); err != nil {
+			return nil, err
+		}
+	}
+
+	if order.Status == acme.StatusPending {
+		authz := make([]acme.Authorization, 0, len(order.Authorizations))
+		for _, u := range order.Authorizations {
+			a, err := core.Authorizations.Get(u)
+			if err != nil {
+				return nil, err
+			}
+			authz = append(authz, a)
+		}
+		if err = resolver.NewProber(i.client.Challenge).Solve(authz); err != nil {
+			return nil, err
+		}
+	}
+	return i.finalize(core, order, domains, privateKey)
+}
+
+// finalize submits CSR of privateKey for ready order and downloads issued certificate.
+func (i *tlsAcmeIssuer) finalize(core *api.Core, order acme.ExtendedOrder, domains []string, privateKey crypto.PrivateKey) (*certificate.Resource, error) {
+	csr, err := certcrypto.GenerateCSR(privateKey, domains[0], domains, false)
+	if err != nil {
+		return nil, err
+	}
+	done, err := core.Orders.UpdateForCSR(order.Finalize, csr)
+	if err != nil {
+		return nil, err
+	}
+	err = wait.For("certificate", 30*time.Second, time.Second, func() (bool, error) {
+		switch done.Status {
+		case acme.StatusValid:
+			return true, nil
+		case acme.StatusInvalid:
+			return false, done.Error
+		}
+		done, err = core.Orders.Get(order.Location)
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cert, issuer, err := core.Certificates.Get(done.Certificate, true)
+	if err != nil {
+		return nil, err
+	}
+	return &certificate.Resource{
+		Domain:            domains[0],
+		CertURL:           done.Certificate,
+		CertStableURL:     done.Certificate,
+		PrivateKey:        certcrypto.PEMEncode(privateKey),
+		Certificate:       cert,
+		IssuerCertificate: issuer,
+	}, nil
+}
+
+func (i *tlsAcmeIssuer) ObtainForCSR(csr *x509.CertificateRequest) (*certificate.Resource, error) {
+	return i.client.Certificate.ObtainForCSR(certificate.ObtainForCSRRequest{CSR: csr, Bundle: true})
+}
+
+func (i *tlsAcmeIssuer) Annotate(meta *TlsCertMeta) {
+	meta.Backend = TlsIssuerAcme
+	meta.Account = i.user.Email
+	if i.user.Registration != nil {
+		meta.AccountURI = i.user.Registration.URI
+	}
+	meta.Challenge = i.at.challenge()
+	meta.DirectoryURL = i.at.caDirUrl()
+}
+
+// ----- Vault PKI -----
+
+// TlsVaultPkiIssuer signs CSRs with Vault PKI secrets engine (<Mount>/sign/<Role>),
+// private keys never leave the storage.
+type TlsVaultPkiIssuer struct {
+	Logical *vaultapi.Logical
+	Mount   string
+	Role    string
+	TTL     string // role default when empty
+}
+
+func (i *TlsVaultPkiIssuer) Obtain(domains []string, privateKey crypto.PrivateKey) (*certificate.Resource, error) {
+	csr, err := tlsCsr(domains, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	res, err := i.sign(csr, domains[0])
+	if err != nil {
+		return nil, err
+	}
+	res.PrivateKey = pem.EncodeToMemory(certcrypto.PEMBlock(privateKey))
+	return res, nil
+}
+
+func (i *TlsVaultPkiIssuer) ObtainForCSR(csr *x509.CertificateRequest) (*certificate.Resource, error) {
+	csrPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	return i.sign(csrPem, csrDomains(csr)[0])
+}
+
+func (i *TlsVaultPkiIssuer) sign(csr []byte, commonName string) (*certificate.Resource, error) {
+	data := map[string]interface{}{
+		"csr":         string(csr),
+		"common_name": commonName,
+		"format":      "pem",
+	}
+	if i.TTL != "" {
+		data["ttl"] = i.TTL
+	}
+	secret, err := i.Logical.Write(i.signPath(), data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("Vault returned no certificate from %s", i.signPath())
+	}
+
+	leaf, _ := secret.Data["certificate"].(string)
+	issuingCa, _ := secret.Data["issuing_ca"].(string)
+	if leaf == "" {
+		return nil, fmt.Errorf("Vault returned no certificate from %s", i.signPath())
+	}
+
+	chain := []string{strings.TrimSpace(leaf)}
+	if caChain, ok := secret.Data["ca_chain"].([]interface{}); ok && len(caChain) > 0 {
+		for _, ca := range caChain {
+			if s, ok := ca.(string); ok {
+				chain = append(chain, strings.TrimSpace(s))
+			}
+		}
+	} else if issuingCa != "" {
+		chain = append(chain, strings.TrimSpace(issuingCa))
+	}
+
+	res := &certificate.Resource{
+		Domain:      commonName,
+		Certificate: []byte(strings.Join(chain, "\n") + "\n"),
+	}
+	// .ca is not written when Vault does not return issuing CA
+	if issuingCa != "" {
+		res.IssuerCertificate = []byte(strings.TrimSpace(issuingCa) + "\n")
+	}
+	return res, nil
+}
+
+func (i *TlsVaultPkiIssuer) Annotate(meta *TlsCertMeta) {
+	meta.Backend = TlsIssuerVaultPki
+	meta.DirectoryURL = i.signPath()
+}
+
+func (i *TlsVaultPkiIssuer) signPath() string {
+	mount := i.Mount
+	if mount == "" {
+		mount = "pki"
+	}
+	return path.Join(mount, "sign", i.Role)
+}
+
+// tlsCsr creates PEM encoded CSR, IP addresses are added as IP SANs.
+func tlsCsr(domains []string, privateKey crypto.PrivateKey) ([]byte, error) {
+	tpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: domains[0]}}
+	for _, d := range domains {
+		if ip := net.ParseIP(d); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, d)
+		}
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported private key")
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tpl, signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
@@ -0,0 +1,203 @@
+package cloudh
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// testVaultPki serves <mount>/sign/<role> of Vault PKI, signing CSRs with a test CA.
+// issuing_ca is left out of the response unless withCa is set.
+func testVaultPki(t *testing.T, path string, withCa bool) *vaultapi.Logical {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Vault Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTpl, caTpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDer)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/"+path {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Csr        string `json:"csr"`
+			CommonName string `json:"common_name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		csr, err := certcrypto.PemDecodeTox509CSR([]byte(req.Csr))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: req.CommonName},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, caCert, csr.PublicKey, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := map[string]interface{}{
+			"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		}
+		if withCa {
+			data["issuing_ca"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := vaultapi.NewClient(&vaultapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("test")
+	return client.Logical()
+}
+
+func TestTlsVaultPkiIssuer(t *testing.T) {
+	for _, withCa := range []bool{true, false} {
+		at := &AutoTls{
+			Config: TlsConfig{
+				Domains:        []string{"a.internal", "b.internal"},
+				CertPathPrefix: t.TempDir(),
+				SkipPreflight:  true,
+			},
+			Storage: &TlsFileStorage{},
+			Issuer:  &TlsVaultPkiIssuer{Logical: testVaultPki(t, "pki/sign/web", withCa), Role: "web"},
+		}
+		if err := at.Issue(); err != nil {
+			t.Fatalf("Issue(withCa=%v) = %v", withCa, err)
+		}
+
+		certs, err := at.readCertificate("a.internal", ".crt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain := 1
+		if withCa {
+			chain = 2
+		}
+		if len(certs) != chain {
+			t.Errorf("chain length = %d, want %d", len(certs), chain)
+		}
+		if !equalDomains(certDomains(certs[0]), at.Config.Domains) {
+			t.Errorf("certificate domains = %v", certDomains(certs[0]))
+		}
+
+		ca, err := at.Storage.Exists(context.Background(), at.getCertFileName("a.internal", ".ca"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ca != withCa {
+			b, _ := ioutil.ReadFile(at.getCertFileName("a.internal", ".ca"))
+			t.Errorf(".ca stored = %v, want %v (%q)", ca, withCa, b)
+		}
+
+		var meta TlsCertMeta
+		if _, err = at.readJson(at.getCertFileName("a.internal", ".json"), &meta); err != nil {
+			t.Fatal(err)
+		}
+		if meta.Backend != TlsIssuerVaultPki || meta.DirectoryURL != "pki/sign/web" {
+			t.Errorf("meta = %+v", meta)
+		}
+	}
+}
+
+// testOrderIssuer is Vault PKI issuer with resumable orders, placing order "new".
+type testOrderIssuer struct {
+	*TlsVaultPkiIssuer
+	resumed string
+	err     error
+}
+
+func (i *testOrderIssuer) ObtainOrder(url string, domains []string, privateKey crypto.PrivateKey, placed func(url string) error) (*certificate.Resource, error) {
+	i.resumed = url
+	if url == "" {
+		if err := placed("new"); err != nil {
+			return nil, err
+		}
+	}
+	if i.err != nil {
+		return nil, i.err
+	}
+	return i.Obtain(domains, privateKey)
+}
+
+func TestTlsObtainPendingOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending TlsOrder
+		err     error
+		resumed string
+	}{
+		{name: "resumed", pending: TlsOrder{Domains: []string{"a.internal"}, URL: "stale"}, resumed: "stale"},
+		{name: "domains changed", pending: TlsOrder{Domains: []string{"b.internal"}, URL: "stale"}},
+		{name: "without URL", pending: TlsOrder{Domains: []string{"a.internal"}}},
+		{name: "obtain failed", pending: TlsOrder{Domains: []string{"a.internal"}, URL: "stale"}, err: errors.New("rejected"), resumed: "stale"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := &testOrderIssuer{TlsVaultPkiIssuer: &TlsVaultPkiIssuer{Logical: testVaultPki(t, "pki/sign/web", true), Role: "web"}, err: tt.err}
+			at := &AutoTls{
+				Config: TlsConfig{
+					Domains:        []string{"a.internal"},
+					CertPathPrefix: t.TempDir(),
+					SkipPreflight:  true,
+				},
+				Storage: &TlsFileStorage{},
+				Issuer:  issuer,
+			}
+			b, _ := json.Marshal(tt.pending)
+			if err := at.Storage.Write(context.Background(), at.getCertFileName("a.internal", ".order"), b); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := at.Issue(); !errors.Is(err, tt.err) {
+				t.Fatalf("Issue() = %v, want %v", err, tt.err)
+			}
+			if issuer.resumed != tt.resumed {
+				t.Errorf("resumed order = %q, want %q", issuer.resumed, tt.resumed)
+			}
+			order, err := at.ReadOrder("a.internal")
+			if err != nil || order != nil {
+				t.Errorf("ReadOrder() = %+v, %v, want removed", order, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package cloudh
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// TlsKeyTypes maps key-type names accepted by CLI to lego key types.
+var TlsKeyTypes = map[string]certcrypto.KeyType{
+	"rsa2048": certcrypto.RSA2048,
+	"rsa4096": certcrypto.RSA4096,
+	"rsa8192": certcrypto.RSA8192,
+	"ec256":   certcrypto.EC256,
+	"ec384":   certcrypto.EC384,
+}
+
+const tlsDefaultKeyType = certcrypto.EC384
+
+// TlsKeyTypeName returns name of key type as used by TlsKeyTypes.
+func TlsKeyTypeName(keyType certcrypto.KeyType) string {
+	for name, kt := range TlsKeyTypes {
+		if kt == keyType {
+			return name
+		}
+	}
+	return string(keyType)
+}
+
+// tlsPublicKeyType detects key type of a public key.
+func tlsPublicKeyType(pub crypto.PublicKey) certcrypto.KeyType {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return certcrypto.KeyType(fmt.Sprint(key.N.BitLen()))
+	case *ecdsa.PublicKey:
+		return certcrypto.KeyType(fmt.Sprint("P", key.Curve.Params().BitSize))
+	}
+	return ""
+}
+
+func (at *AutoTls) keyType() certcrypto.KeyType {
+	if at.Config.KeyType != "" {
+		return at.Config.KeyType
+	}
+	return tlsDefaultKeyType
+}
+
+func (at *AutoTls) accountKeyType() certcrypto.KeyType {
+	if at.Config.AccountKeyType != "" {
+		return at.Config.AccountKeyType
+	}
+	return tlsDefaultKeyType
+}
+
+// keyTypeChanged reports whether certificate should be converted
+// to explicitly configured key type.
+func (at *AutoTls) keyTypeChanged(pub crypto.PublicKey) bool {
+	return at.Config.KeyType != "" && tlsPublicKeyType(pub) != at.Config.KeyType
+}
@@ -0,0 +1,193 @@
+package cloudh
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+func TestTlsKeyTypeNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyType certcrypto.KeyType
+		ok      bool
+	}{
+		{name: "rsa2048", keyType: certcrypto.RSA2048, ok: true},
+		{name: "rsa4096", keyType: certcrypto.RSA4096, ok: true},
+		{name: "rsa8192", keyType: certcrypto.RSA8192, ok: true},
+		{name: "ec256", keyType: certcrypto.EC256, ok: true},
+		{name: "ec384", keyType: certcrypto.EC384, ok: true},
+		{name: "EC256"},
+		{name: "P256"},
+		{name: "rsa1024"},
+	}
+	for _, tt := range tests {
+		kt, ok := TlsKeyTypes[tt.name]
+		if ok != tt.ok || kt != tt.keyType {
+			t.Errorf("TlsKeyTypes[%s] = %q, %v, want %q, %v", tt.name, kt, ok, tt.keyType, tt.ok)
+		}
+		if ok {
+			if got := TlsKeyTypeName(kt); got != tt.name {
+				t.Errorf("TlsKeyTypeName(%q) = %s, want %s", kt, got, tt.name)
+			}
+		}
+	}
+	// unknown key types are printed as they are
+	if got := TlsKeyTypeName("P521"); got != "P521" {
+		t.Errorf("TlsKeyTypeName(P521) = %s, want P521", got)
+	}
+}
+
+func TestTlsPublicKeyType(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     crypto.Signer
+		pem     []byte
+		keyType certcrypto.KeyType
+	}{
+		{name: "rsa2048 pkcs1", key: rsaKey, keyType: certcrypto.RSA2048},
+		{name: "rsa2048 pkcs8", pem: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), keyType: certcrypto.RSA2048},
+		{name: "ec256", key: testKey(t, elliptic.P256()), keyType: certcrypto.EC256},
+		{name: "ec384", key: testKey(t, elliptic.P384()), keyType: certcrypto.EC384},
+		{name: "p521", key: testKey(t, elliptic.P521()), keyType: "P521"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.pem
+			if b == nil {
+				b = pem.EncodeToMemory(certcrypto.PEMBlock(tt.key))
+			}
+			key, err := parsePrivateKey(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tlsPublicKeyType(key.(crypto.Signer).Public()); got != tt.keyType {
+				t.Errorf("tlsPublicKeyType() = %q, want %q", got, tt.keyType)
+			}
+		})
+	}
+
+	if _, err = parsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("parsePrivateKey(garbage) succeeded")
+	}
+	if got := tlsPublicKeyType(nil); got != "" {
+		t.Errorf("tlsPublicKeyType(nil) = %q, want empty", got)
+	}
+}
+
+func TestRenewDecisionKeyType(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey := testKey(t, elliptic.P256())
+
+	tests := []struct {
+		name       string
+		key        crypto.Signer
+		configured certcrypto.KeyType
+		convert    bool
+		keyType    certcrypto.KeyType
+		reason     string
+	}{
+		{name: "unset keeps ec256", key: ecKey, keyType: certcrypto.EC256},
+		{name: "unset keeps rsa2048", key: rsaKey, keyType: certcrypto.RSA2048},
+		{name: "same", key: ecKey, configured: certcrypto.EC256, keyType: certcrypto.EC256},
+		{
+			name:       "ec256 to rsa2048",
+			key:        ecKey,
+			configured: certcrypto.RSA2048,
+			convert:    true,
+			keyType:    certcrypto.RSA2048,
+			reason:     "key type changes from ec256 to rsa2048",
+		},
+		{
+			name:       "rsa2048 to ec384",
+			key:        rsaKey,
+			configured: certcrypto.EC384,
+			convert:    true,
+			keyType:    certcrypto.EC384,
+			reason:     "key type changes from rsa2048 to ec384",
+		},
+		{
+			name:       "ec256 to ec384",
+			key:        ecKey,
+			configured: certcrypto.EC384,
+			convert:    true,
+			keyType:    certcrypto.EC384,
+			reason:     "key type changes from ec256 to ec384",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := &AutoTls{
+				Config:  TlsConfig{Domains: []string{"a.com"}, KeyType: tt.configured, CertPathPrefix: t.TempDir()},
+				Storage: &TlsFileStorage{},
+			}
+			tpl := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "a.com"},
+				DNSNames:     []string{"a.com"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, tt.key.Public(), tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := map[string][]byte{
+				".crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+				".key": pem.EncodeToMemory(certcrypto.PEMBlock(tt.key)),
+			}
+			for ext, b := range files {
+				if err := at.Storage.Write(context.Background(), at.getCertFileName("a.com", ext), b); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d, err := at.renewDecision("a.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.convert != tt.convert || d.keyType != tt.keyType {
+				t.Errorf("renewDecision() convert = %v, key type = %q, want %v, %q", d.convert, d.keyType, tt.convert, tt.keyType)
+			}
+			// certificate is not due, only key type change renews it
+			if d.renew != tt.convert {
+				t.Errorf("renewDecision() renew = %v, want %v", d.renew, tt.convert)
+			}
+			if tt.reason != "" && d.reason != tt.reason {
+				t.Errorf("renewDecision() reason = %q, want %q", d.reason, tt.reason)
+			}
+		})
+	}
+}
+
+func testKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
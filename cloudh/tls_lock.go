@@ -0,0 +1,153 @@
+package cloudh
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/qbart/ohowl/tea"
+)
+
+const tlsLockSessionTTL = "60s"
+
+// ErrTlsLocked is returned by TlsLocker when lock is held elsewhere
+// and caller does not want to wait.
+var ErrTlsLocked = errors.New("Lock is held by another process")
+
+// ErrTlsLockUnsupported is returned by TlsLocker decorators
+// when the underlying storage can't be locked.
+var ErrTlsLockUnsupported = errors.New("Storage does not support locking")
+
+// TlsLocker is implemented by storages that can guard certificate orders
+// across processes/nodes sharing the same storage.
+type TlsLocker interface {
+	Lock(ctx context.Context, key string, wait bool) (unlock func() error, err error)
+}
+
+// ----- TlsFileStorage -----
+
+func (fs *TlsFileStorage) Lock(ctx context.Context, key string, wait bool) (func() error, error) {
+	// lock is taken before the first certificate of a domain is written
+	if err := os.MkdirAll(filepath.Dir(key), 0o700); err != nil {
+		return nil, err
+	}
+	lock, err := tea.LockFile(key, wait)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		return nil, ErrTlsLocked
+	}
+	return lock.Unlock, nil
+}
+
+// ----- TlsConsulStorage -----
+
+// Lock acquires key using a Consul session. Session is renewed in background
+// until unlock is called, lock key is removed when session gets invalidated.
+func (fs *TlsConsulStorage) Lock(ctx context.Context, key string, wait bool) (func() error, error) {
+	if fs.Session == nil {
+		return nil, errors.New("Consul session client is not configured")
+	}
+
+	id, _, err := fs.Session.Create(&consulapi.SessionEntry{
+		Name:     "owl-tls-lock",
+		TTL:      tlsLockSessionTTL,
+		Behavior: consulapi.SessionBehaviorDelete,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go fs.Session.RenewPeriodic(tlsLockSessionTTL, id, nil, done)
+
+	unlock := func() error {
+		// closing done destroys the session
+		defer close(done)
+		_, _, err := fs.KV.Release(&consulapi.KVPair{Key: key, Session: id}, nil)
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	for {
+		acquired, _, err := fs.KV.Acquire(&consulapi.KVPair{Key: key, Value: []byte(hostname), Session: id}, nil)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if acquired {
+			return unlock, nil
+		}
+		if !wait {
+			unlock()
+			return nil, ErrTlsLocked
+		}
+
+		// block until the lock key changes
+		kv, meta, err := fs.KV.Get(key, nil)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if kv != nil && kv.Session != "" {
+			log.Printf("Waiting for lock %s held by %s", key, string(kv.Value))
+			_, _, err = fs.KV.Get(key, (&consulapi.QueryOptions{
+				WaitIndex: meta.LastIndex,
+				WaitTime:  30 * time.Second,
+			}).WithContext(ctx))
+			if err != nil {
+				unlock()
+				return nil, err
+			}
+		}
+	}
+}
+
+// ----- AutoTls -----
+
+func (at *AutoTls) ctx() context.Context {
+	if at.Context == nil {
+		return context.Background()
+	}
+	return at.Context
+}
+
+// withLock runs fn while holding per-domain lock (when storage supports locking)
+// and reports whether fn was run. When lock is held elsewhere fn is skipped,
+// unless Config.LockWait is set. Lock is released when fn returns, fn is expected
+// to return early once Context is cancelled.
+func (at *AutoTls) withLock(domain string, fn func() error) (bool, error) {
+	locker, ok := at.Storage.(TlsLocker)
+	if !ok {
+		log.Printf("[%s] Storage does not support locking, continuing without lock", domain)
+		return true, fn()
+	}
+
+	if at.Config.LockWait {
+		log.Printf("[%s] Acquiring lock", domain)
+	}
+	unlock, err := locker.Lock(at.ctx(), at.getCertFileName(domain, ".lock"), at.Config.LockWait)
+	if err == ErrTlsLockUnsupported {
+		log.Printf("[%s] Storage does not support locking, continuing without lock", domain)
+		return true, fn()
+	}
+	if err == ErrTlsLocked {
+		log.Printf("[%s] Certificate is being ordered by another process, skipping", domain)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			log.Printf("[%s] Failed to release lock: %v", domain, err)
+		}
+	}()
+
+	return true, fn()
+}
@@ -0,0 +1,31 @@
+package cloudh
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestTlsFileStorageLock(t *testing.T) {
+	fs := &TlsFileStorage{}
+	// certificate directory does not exist before the first issue
+	key := filepath.Join(t.TempDir(), "tls", "a.com.lock")
+
+	unlock, err := fs.Lock(context.Background(), key, false)
+	if err != nil {
+		t.Fatalf("Lock() = %v", err)
+	}
+	if _, err = fs.Lock(context.Background(), key, false); !errors.Is(err, ErrTlsLocked) {
+		t.Errorf("second Lock() = %v, want %v", err, ErrTlsLocked)
+	}
+	if err = unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err = fs.Lock(context.Background(), key, false)
+	if err != nil {
+		t.Fatalf("Lock() after unlock = %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,207 @@
+package cloudh
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+// TlsCertMeta is kept as <domain>.json next to .key/.crt/.ca.
+type TlsCertMeta struct {
+	Domains       []string  `json:"domains"`
+	CertURL       string    `json:"cert_url,omitempty"`
+	CertStableURL string    `json:"cert_stable_url,omitempty"`
+	KeyType       string    `json:"key_type,omitempty"`
+	Issuer        string    `json:"issuer,omitempty"`
+	Serial        string    `json:"serial,omitempty"`
+	IssuedAt      time.Time `json:"issued_at"`
+	NotAfter      time.Time `json:"not_after"`
+	Account       string    `json:"account,omitempty"`
+	AccountURI    string    `json:"account_uri,omitempty"`
+	Challenge     string    `json:"challenge,omitempty"`
+	DirectoryURL  string    `json:"directory_url,omitempty"`
+	Backend       string    `json:"backend,omitempty"`
+	DeployError   string    `json:"deploy_error,omitempty"`
+}
+
+// TlsOrder is kept as <domain>.order while the certificate is being ordered,
+// an order left behind was interrupted (e.g. by a crash) and is resumed
+// from URL by the next issue/renew when the issuer supports it.
+type TlsOrder struct {
+	Domains   []string  `json:"domains"`
+	URL       string    `json:"url,omitempty"`
+	KeyType   string    `json:"key_type,omitempty"`
+	Challenge string    `json:"challenge,omitempty"`
+	Account   string    `json:"account,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// ReadOrder returns pending order of domain, nil when there is none.
+func (at *AutoTls) ReadOrder(domain string) (*TlsOrder, error) {
+	var order TlsOrder
+	ok, err := at.readJson(at.getCertFileName(domain, ".order"), &order)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// obtain orders certificate for domains, privateKey is generated when nil.
+func (at *AutoTls) obtain(issuer TlsIssuer, domains []string, privateKey crypto.PrivateKey, keyType certcrypto.KeyType) error {
+	domain := domains[0]
+
+	if !at.Config.SkipPreflight {
+		if _, err := at.Preflight(domains); err != nil {
+			return fmt.Errorf("[%s] %w", domain, err)
+		}
+	}
+
+	if privateKey == nil {
+		var err error
+		if privateKey, err = certcrypto.GeneratePrivateKey(keyType); err != nil {
+			return err
+		}
+	}
+	res, err := at.order(issuer, domains, privateKey, keyType)
+	if err != nil {
+		return err
+	}
+
+	if err = at.saveResource(res, issuer); err != nil {
+		return err
+	}
+	return at.deployIssued(domain)
+}
+
+// order obtains certificate from issuer while <domain>.order is kept,
+// the marker is removed however the order ends.
+func (at *AutoTls) order(issuer TlsIssuer, domains []string, privateKey crypto.PrivateKey, keyType certcrypto.KeyType) (res *certificate.Resource, err error) {
+	domain := domains[0]
+	orderKey := at.getCertFileName(domain, ".order")
+
+	pending, err := at.ReadOrder(domain)
+	if err != nil {
+		return nil, err
+	}
+	order := TlsOrder{
+		Domains:   domains,
+		KeyType:   TlsKeyTypeName(keyType),
+		Challenge: at.challenge(),
+		Account:   at.Config.Email,
+		StartedAt: time.Now().UTC(),
+	}
+	_, resumable := issuer.(tlsOrderIssuer)
+	if pending != nil {
+		if resumable && pending.URL != "" && equalDomains(pending.Domains, domains) {
+			order.URL = pending.URL
+		} else {
+			log.Printf("[%s] Replacing order interrupted at %s", domain, pending.StartedAt.Format(time.RFC3339))
+		}
+	}
+	write := func() error {
+		b, err := json.MarshalIndent(order, "", "\t")
+		if err != nil {
+			return err
+		}
+		return at.Storage.Write(context.TODO(), orderKey, b)
+	}
+	if err = write(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if derr := at.Storage.Delete(context.TODO(), orderKey); err == nil {
+			err = derr
+		}
+	}()
+
+	if err = at.ctx().Err(); err != nil {
+		return nil, err
+	}
+	if oi, ok := issuer.(tlsOrderIssuer); ok {
+		return oi.ObtainOrder(order.URL, domains, privateKey, func(url string) error {
+			order.URL = url
+			return write()
+		})
+	}
+	return issuer.Obtain(domains, privateKey)
+}
+
+func (at *AutoTls) certMeta(res *certificate.Resource, issuer TlsIssuer) ([]byte, error) {
+	cert, err := certcrypto.ParsePEMCertificate(res.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := TlsCertMeta{
+		Domains:       certDomains(cert),
+		CertURL:       res.CertURL,
+		CertStableURL: res.CertStableURL,
+		KeyType:       TlsKeyTypeName(tlsPublicKeyType(cert.PublicKey)),
+		Issuer:        cert.Issuer.CommonName,
+		Serial:        cert.SerialNumber.Text(16),
+		IssuedAt:      cert.NotBefore,
+		NotAfter:      cert.NotAfter,
+	}
+	issuer.Annotate(&meta)
+	return json.MarshalIndent(meta, "", "\t")
+}
+
+func (at *AutoTls) readJson(key string, o interface{}) (bool, error) {
+	exists, err := at.Storage.Exists(context.TODO(), key)
+	if !exists || err != nil {
+		return false, err
+	}
+	b, err := at.Storage.Read(context.TODO(), key)
+	if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(b, o); err != nil {
+		return false, fmt.Errorf("Invalid %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (at *AutoTls) challenge() string {
+	if at.Config.Challenge == "" {
+		return TlsChallengeDns01
+	}
+	return at.Config.Challenge
+}
+
+// certDomains returns common name and SANs of cert, IP SANs included.
+func certDomains(cert *x509.Certificate) []string {
+	domains := certcrypto.ExtractDomains(cert)
+	for _, ip := range ipStrings(cert.IPAddresses) {
+		if len(diffDomains([]string{ip}, domains)) > 0 {
+			domains = append(domains, ip)
+		}
+	}
+	return domains
+}
+
+func equalDomains(a, b []string) bool {
+	return len(diffDomains(a, b)) == 0 && len(diffDomains(b, a)) == 0
+}
+
+// diffDomains returns domains of a missing in b (case insensitive).
+func diffDomains(a, b []string) []string {
+	set := make(map[string]bool, len(b))
+	for _, d := range b {
+		set[strings.ToLower(d)] = true
+	}
+	res := make([]string, 0)
+	for _, d := range a {
+		if !set[strings.ToLower(d)] {
+			res = append(res, d)
+		}
+	}
+	return res
+}
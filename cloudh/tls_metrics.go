@@ -0,0 +1,144 @@
+package cloudh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tlsOperationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "owl_tls_operations_total",
+		Help: "Issue/renew attempts.",
+	}, []string{"operation"})
+
+	tlsFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "owl_tls_failures_total",
+		Help: "Failed issue/renew attempts by error class.",
+	}, []string{"operation", "class"})
+
+	tlsOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "owl_tls_operation_duration_seconds",
+		Help:    "Duration of issue/renew attempts.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600},
+	}, []string{"operation"})
+
+	tlsAcmeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "owl_tls_acme_request_duration_seconds",
+		Help:    "Latency of requests to ACME server.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	tlsCertExpiryDesc = prometheus.NewDesc(
+		"owl_tls_cert_expiry_timestamp_seconds",
+		"Certificate expiry (NotAfter) as unix timestamp.",
+		[]string{"domain", "path", "storage"}, nil,
+	)
+
+	tlsCertListUpDesc = prometheus.NewDesc(
+		"owl_tls_cert_list_up",
+		"Whether certificates could be listed from storage.",
+		[]string{"storage"}, nil,
+	)
+)
+
+var acmeErrorRegexp = regexp.MustCompile(`urn:ietf:params:acme:error:([A-Za-z]+)`)
+
+// TlsCertCollector exports expiry of certificates from Tls.List on every scrape.
+// Storage is used as label value only.
+type TlsCertCollector struct {
+	Tls     *AutoTls
+	Storage string
+}
+
+func (c *TlsCertCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tlsCertExpiryDesc
+	ch <- tlsCertListUpDesc
+}
+
+func (c *TlsCertCollector) Collect(ch chan<- prometheus.Metric) {
+	certs, err := c.Tls.List()
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(tlsCertListUpDesc, prometheus.GaugeValue, 0, c.Storage)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(tlsCertListUpDesc, prometheus.GaugeValue, 1, c.Storage)
+
+	for _, cert := range certs {
+		ch <- prometheus.MustNewConstMetric(tlsCertExpiryDesc, prometheus.GaugeValue,
+			float64(cert.Expiry.Unix()), cert.CommonName, cert.Path, c.Storage)
+	}
+}
+
+// tlsObserve records attempt of operation started at start, failed when err is set.
+func tlsObserve(operation string, start time.Time, err error) {
+	// certificate was stored, deploy failures are counted on their own
+	var deployErr *TlsDeployError
+	if errors.As(err, &deployErr) {
+		tlsFailuresTotal.WithLabelValues("deploy", tlsErrorClass(deployErr.Err)).Inc()
+		err = nil
+	}
+
+	tlsOperationsTotal.WithLabelValues(operation).Inc()
+	tlsOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		tlsFailuresTotal.WithLabelValues(operation, tlsErrorClass(err)).Inc()
+	}
+}
+
+// tlsErrorClass maps err to a low cardinality label value,
+// ACME problems are classified by their type (rateLimited, unauthorized, ...).
+func tlsErrorClass(err error) string {
+	var problem *acme.ProblemDetails
+	if errors.As(err, &problem) {
+		if m := acmeErrorRegexp.FindStringSubmatch(problem.Type); m != nil {
+			return m[1]
+		}
+	}
+	// lego joins per-domain errors into a single message
+	if m := acmeErrorRegexp.FindStringSubmatch(err.Error()); m != nil {
+		return m[1]
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrTlsLocked):
+		return "locked"
+	case errors.Is(err, ErrTlsPreflight):
+		return "preflight"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// tlsAcmeRoundTripper measures latency of ACME requests
+// and aborts them when ctx is cancelled.
+type tlsAcmeRoundTripper struct {
+	next http.RoundTripper
+	ctx  context.Context
+}
+
+func (rt *tlsAcmeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.ctx != nil {
+		req = req.WithContext(rt.ctx)
+	}
+	start := time.Now()
+	res, err := rt.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	tlsAcmeRequestDuration.WithLabelValues(req.Method, code).Observe(time.Since(start).Seconds())
+	return res, err
+}
@@ -0,0 +1,173 @@
+package cloudh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type testNetError struct{ timeout bool }
+
+func (e testNetError) Error() string   { return "connection refused" }
+func (e testNetError) Timeout() bool   { return e.timeout }
+func (e testNetError) Temporary() bool { return false }
+
+func TestTlsErrorClass(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{name: "acme problem", err: &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:rateLimited"}, class: "rateLimited"},
+		{
+			name:  "wrapped acme problem",
+			err:   fmt.Errorf("[a.com] %w", &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:unauthorized"}),
+			class: "unauthorized",
+		},
+		{name: "joined by lego", err: errors.New("error: one or more domains had a problem:\n[a.com] acme: error: 400 :: urn:ietf:params:acme:error:dns :: NXDOMAIN"), class: "dns"},
+		{name: "locked", err: fmt.Errorf("[a.com] %w", ErrTlsLocked), class: "locked"},
+		{name: "preflight", err: fmt.Errorf("[a.com] %w", ErrTlsPreflight), class: "preflight"},
+		{name: "timeout", err: &net.OpError{Op: "dial", Err: testNetError{timeout: true}}, class: "timeout"},
+		{name: "network", err: &net.OpError{Op: "dial", Err: testNetError{}}, class: "network"},
+		{name: "other", err: errors.New("boom"), class: "other"},
+	}
+	for _, tt := range tests {
+		if got := tlsErrorClass(tt.err); got != tt.class {
+			t.Errorf("%s: tlsErrorClass() = %s, want %s", tt.name, got, tt.class)
+		}
+	}
+}
+
+// testHistogramCount returns number of observations of histogram.
+func testHistogramCount(t *testing.T, h prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestTlsObserve(t *testing.T) {
+	locked := fmt.Errorf("[a.com] %w", ErrTlsLocked)
+	tests := []struct {
+		name      string
+		operation string
+		err       error
+		failures  map[[2]string]float64
+	}{
+		{name: "success", operation: "issue"},
+		{name: "failure", operation: "renew", err: locked, failures: map[[2]string]float64{{"renew", "locked"}: 1}},
+		{
+			name:      "deploy failure counts as success",
+			operation: "renew",
+			err:       &TlsDeployError{Domain: "a.com", Err: errors.New("hook failed")},
+			failures:  map[[2]string]float64{{"deploy", "other"}: 1, {"renew", "other"}: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := tlsOperationsTotal.WithLabelValues(tt.operation)
+			hist := tlsOperationDuration.WithLabelValues(tt.operation)
+			opsBefore, histBefore := testutil.ToFloat64(ops), testHistogramCount(t, hist)
+			failuresBefore := make(map[[2]string]float64, len(tt.failures))
+			for labels := range tt.failures {
+				failuresBefore[labels] = testutil.ToFloat64(tlsFailuresTotal.WithLabelValues(labels[0], labels[1]))
+			}
+
+			tlsObserve(tt.operation, time.Now().Add(-2*time.Second), tt.err)
+
+			if got := testutil.ToFloat64(ops) - opsBefore; got != 1 {
+				t.Errorf("operations{operation=%s} increased by %v, want 1", tt.operation, got)
+			}
+			if got := testHistogramCount(t, hist) - histBefore; got != 1 {
+				t.Errorf("duration{operation=%s} observed %d times, want 1", tt.operation, got)
+			}
+			for labels, want := range tt.failures {
+				got := testutil.ToFloat64(tlsFailuresTotal.WithLabelValues(labels[0], labels[1])) - failuresBefore[labels]
+				if got != want {
+					t.Errorf("failures{operation=%s,class=%s} increased by %v, want %v", labels[0], labels[1], got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTlsAcmeRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	rt := &tlsAcmeRoundTripper{next: http.DefaultTransport}
+	before := testHistogramCount(t, tlsAcmeRequestDuration.WithLabelValues("HEAD", "429"))
+	res, err := (&http.Client{Transport: rt}).Head(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := testHistogramCount(t, tlsAcmeRequestDuration.WithLabelValues("HEAD", "429")) - before; got != 1 {
+		t.Errorf("acme request{method=HEAD,code=429} observed %d times, want 1", got)
+	}
+
+	// cancelled context aborts request, labelled as error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rt.ctx = ctx
+	before = testHistogramCount(t, tlsAcmeRequestDuration.WithLabelValues("HEAD", "error"))
+	if _, err = (&http.Client{Transport: rt}).Head(srv.URL); err == nil {
+		t.Fatal("request with cancelled context succeeded")
+	}
+	if got := testHistogramCount(t, tlsAcmeRequestDuration.WithLabelValues("HEAD", "error")) - before; got != 1 {
+		t.Errorf("acme request{method=HEAD,code=error} observed %d times, want 1", got)
+	}
+}
+
+func TestTlsCertCollector(t *testing.T) {
+	dir := t.TempDir()
+	at := &AutoTls{Config: TlsConfig{CertPathPrefix: dir}, Storage: &TlsFileStorage{}}
+	testStoreCertificate(t, at, "a.com", "")
+	certs, err := at.List()
+	if err != nil || len(certs) != 1 {
+		t.Fatalf("List() = %v, %v", certs, err)
+	}
+
+	c := &TlsCertCollector{Tls: at, Storage: "fs"}
+	want := fmt.Sprintf(`
+# HELP owl_tls_cert_expiry_timestamp_seconds Certificate expiry (NotAfter) as unix timestamp.
+# TYPE owl_tls_cert_expiry_timestamp_seconds gauge
+owl_tls_cert_expiry_timestamp_seconds{domain="a.com",path="%s",storage="fs"} %g
+# HELP owl_tls_cert_list_up Whether certificates could be listed from storage.
+# TYPE owl_tls_cert_list_up gauge
+owl_tls_cert_list_up{storage="fs"} 1
+`, certs[0].Path, float64(certs[0].Expiry.Unix()))
+	if err = testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// unreadable certificate fails listing
+	if err = ioutil.WriteFile(filepath.Join(dir, "b.com.crt"), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	want = `
+# HELP owl_tls_cert_list_up Whether certificates could be listed from storage.
+# TYPE owl_tls_cert_list_up gauge
+owl_tls_cert_list_up{storage="fs"} 0
+`
+	if err = testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,225 @@
+package cloudh
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// TlsMigration describes a single copied key.
+type TlsMigration struct {
+	From     string
+	To       string
+	Size     int
+	Checksum string
+}
+
+// TlsArchiveSource is a storage prefix kept in archive under Name directory.
+type TlsArchiveSource struct {
+	Name    string
+	Storage TlsStorage
+	Prefix  string
+}
+
+// ErrTlsSealedValue is returned by TlsMigrate and TlsExport for an encrypted value
+// read from storage without encryption settings (it would be sealed twice
+// or exported as ciphertext).
+var ErrTlsSealedValue = errors.New("Value is encrypted, set encryption of the source storage")
+
+// TlsMigrate copies every key found under fromPrefix into to storage
+// (relative paths are kept) and verifies written data by checksum.
+// Nothing is written when dryRun is set.
+func TlsMigrate(ctx context.Context, from TlsStorage, fromPrefix string, to TlsStorage, toPrefix string, dryRun bool) ([]TlsMigration, error) {
+	keys, err := from.Find(ctx, fromPrefix, "")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]TlsMigration, 0, len(keys))
+	for _, key := range keys {
+		rel, ok := tlsRelativeKey(fromPrefix, key)
+		if !ok {
+			continue
+		}
+		b, err := tlsReadPlain(ctx, from, key)
+		if err != nil {
+			return res, err
+		}
+
+		m := TlsMigration{
+			From:     key,
+			To:       path.Join(toPrefix, rel),
+			Size:     len(b),
+			Checksum: tlsChecksum(b),
+		}
+		if !dryRun {
+			if err = to.Write(ctx, m.To, b); err != nil {
+				return res, fmt.Errorf("Failed to write %s: %w", m.To, err)
+			}
+			written, err := to.Read(ctx, m.To)
+			if err != nil {
+				return res, fmt.Errorf("Failed to verify %s: %w", m.To, err)
+			}
+			if sum := tlsChecksum(written); sum != m.Checksum {
+				return res, fmt.Errorf("Checksum mismatch for %s: %s != %s", m.To, sum, m.Checksum)
+			}
+		}
+		res = append(res, m)
+	}
+
+	return res, nil
+}
+
+// TlsExport packs every key of sources into tar.gz archive.
+func TlsExport(ctx context.Context, w io.Writer, sources []TlsArchiveSource) ([]TlsMigration, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	res := make([]TlsMigration, 0)
+
+	for _, src := range sources {
+		keys, err := src.Storage.Find(ctx, src.Prefix, "")
+		if err != nil {
+			return res, err
+		}
+		for _, key := range keys {
+			rel, ok := tlsRelativeKey(src.Prefix, key)
+			if !ok {
+				continue
+			}
+			b, err := tlsReadPlain(ctx, src.Storage, key)
+			if err != nil {
+				return res, err
+			}
+
+			name := path.Join(src.Name, rel)
+			err = tw.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0o600,
+				Size:    int64(len(b)),
+				ModTime: time.Now(),
+			})
+			if err != nil {
+				return res, err
+			}
+			if _, err = tw.Write(b); err != nil {
+				return res, err
+			}
+			res = append(res, TlsMigration{From: key, To: name, Size: len(b), Checksum: tlsChecksum(b)})
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return res, err
+	}
+	return res, gz.Close()
+}
+
+// TlsImport writes keys from tar.gz archive created by TlsExport into sources
+// matched by archive directory. Entries without a matching source are skipped.
+func TlsImport(ctx context.Context, r io.Reader, sources []TlsArchiveSource, dryRun bool) ([]TlsMigration, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	res := make([]TlsMigration, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		parts := strings.SplitN(hdr.Name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, dst := range sources {
+			if dst.Name != parts[0] {
+				continue
+			}
+			to, err := tlsArchiveKey(dst.Prefix, parts[1])
+			if err != nil {
+				return res, fmt.Errorf("Invalid archive entry %s: %w", hdr.Name, err)
+			}
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return res, err
+			}
+
+			m := TlsMigration{From: hdr.Name, To: to, Size: len(b), Checksum: tlsChecksum(b)}
+			if !dryRun {
+				if err = dst.Storage.Write(ctx, m.To, b); err != nil {
+					return res, fmt.Errorf("Failed to write %s: %w", m.To, err)
+				}
+			}
+			res = append(res, m)
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// tlsReadPlain reads key, TlsEncryptedStorage opens sealed values
+// so one left sealed was read without a wrapper.
+func tlsReadPlain(ctx context.Context, s TlsStorage, key string) ([]byte, error) {
+	b, err := s.Read(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %w", key, err)
+	}
+	if TlsSealed(b) {
+		return nil, fmt.Errorf("Failed to read %s: %w", key, ErrTlsSealedValue)
+	}
+	return b, nil
+}
+
+// tlsArchiveKey joins archive entry name with prefix, names that are absolute,
+// contain ".." or would end up outside of prefix are rejected.
+func tlsArchiveKey(prefix, name string) (string, error) {
+	if name == "" || path.IsAbs(name) || strings.Contains(name, "\\") {
+		return "", errors.New("name must be a relative path")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("name must not contain ..")
+		}
+	}
+
+	root := path.Clean(prefix)
+	key := path.Join(root, name)
+	if key == root || root != "." && root != "/" && !strings.HasPrefix(key, root+"/") {
+		return "", fmt.Errorf("name is outside of %s", prefix)
+	}
+	return key, nil
+}
+
+// tlsRelativeKey skips locks and temporary files.
+func tlsRelativeKey(prefix, key string) (string, bool) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+	if rel == "" || strings.HasSuffix(rel, ".lock") || strings.Contains(rel, ".tmp-") {
+		return "", false
+	}
+	return rel, true
+}
+
+func tlsChecksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,118 @@
+package cloudh
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTlsArchiveKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		want   string
+		err    bool
+	}{
+		{prefix: "/etc/owl", name: "a.com.crt", want: "/etc/owl/a.com.crt"},
+		{prefix: "/etc/owl/", name: "acc/x.key", want: "/etc/owl/acc/x.key"},
+		{prefix: "tls", name: "./a.com.crt", want: "tls/a.com.crt"},
+		{prefix: "", name: "a.com.crt", want: "a.com.crt"},
+		{prefix: "/etc/owl", name: "../passwd", err: true},
+		{prefix: "/etc/owl", name: "a/../../passwd", err: true},
+		{prefix: "/etc/owl", name: "a/../b.crt", err: true},
+		{prefix: "/etc/owl", name: "/etc/passwd", err: true},
+		{prefix: "/etc/owl", name: "..\\passwd", err: true},
+		{prefix: "/etc/owl", name: ".", err: true},
+		{prefix: "/etc/owl", name: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tlsArchiveKey(tt.prefix, tt.name)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("tlsArchiveKey(%q, %q) = %q, want error", tt.prefix, tt.name, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("tlsArchiveKey(%q, %q) = %q, want %q", tt.prefix, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTlsImportRejectsEscapingEntries(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		dir := t.TempDir()
+		prefix := filepath.Join(dir, "certs")
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for _, name := range []string{"cert/a.com.crt", "cert/../evil.crt"} {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o600, Size: 4})
+			tw.Write([]byte("data"))
+		}
+		tw.Close()
+		gz.Close()
+
+		sources := []TlsArchiveSource{{Name: "cert", Storage: &TlsFileStorage{}, Prefix: prefix}}
+		res, err := TlsImport(context.Background(), &buf, sources, dryRun)
+		if err == nil {
+			t.Fatalf("TlsImport(dryRun=%v) succeeded, want error", dryRun)
+		}
+		if len(res) != 1 || res[0].To != filepath.Join(prefix, "a.com.crt") {
+			t.Errorf("TlsImport(dryRun=%v) = %+v", dryRun, res)
+		}
+		if _, err = os.Stat(filepath.Join(dir, "evil.crt")); !os.IsNotExist(err) {
+			t.Errorf("entry escaped prefix (dryRun=%v): %v", dryRun, err)
+		}
+	}
+}
+
+func TestTlsMigrateSealedWithoutWrapper(t *testing.T) {
+	ctx := context.Background()
+	w := &TlsFileKeyWrapper{Key: bytes.Repeat([]byte{1}, 32)}
+	from, to := filepath.Join(t.TempDir(), "tls"), filepath.Join(t.TempDir(), "tls")
+	sealed := &TlsEncryptedStorage{Storage: &TlsFileStorage{}, Wrapper: w}
+	if err := sealed.Write(ctx, filepath.Join(from, "a.com.key"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		from TlsStorage
+		err  error
+	}{
+		{name: "without wrapper", from: &TlsFileStorage{}, err: ErrTlsSealedValue},
+		{name: "with wrapper", from: sealed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := &TlsEncryptedStorage{Storage: &TlsFileStorage{}, Wrapper: w}
+			if _, err := TlsMigrate(ctx, tt.from, from, dst, to, false); !errors.Is(err, tt.err) {
+				t.Fatalf("TlsMigrate() = %v, want %v", err, tt.err)
+			}
+			sources := []TlsArchiveSource{{Name: "cert", Storage: tt.from, Prefix: from}}
+			if _, err := TlsExport(ctx, ioutil.Discard, sources); !errors.Is(err, tt.err) {
+				t.Fatalf("TlsExport() = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			b, err := dst.Read(ctx, filepath.Join(to, "a.com.key"))
+			if err != nil || string(b) != "secret" {
+				t.Errorf("migrated a.com.key = %q, %v, want secret", b, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package cloudh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+const (
+	TlsPlanIssue  = "issue"
+	TlsPlanRenew  = "renew"
+	TlsPlanDeploy = "deploy" // deploy retry of certificate not due for renewal
+	TlsPlanSkip   = "skip"
+)
+
+// TlsPlan describes what Issue/Renew would do, it is built from storage only
+// (the CA is not contacted and nothing is written).
+type TlsPlan struct {
+	Domain  string   `json:"domain"`
+	Domains []string `json:"domains"`
+	Action  string   `json:"action"`
+	Reason  string   `json:"reason"`
+	KeyType string   `json:"key_type,omitempty"`
+	Account string   `json:"account,omitempty"`
+	Issuer  string   `json:"issuer"`
+	Writes  []string `json:"writes,omitempty"`
+	Deletes []string `json:"deletes,omitempty"`
+	Deploy  []string `json:"deploy,omitempty"`
+	Records []string `json:"records,omitempty"`
+	Err     string   `json:"error,omitempty"`
+}
+
+// PlanIssue returns plan of Issue.
+func (at *AutoTls) PlanIssue() (*TlsPlan, error) {
+	if len(at.Config.Domains) == 0 {
+		return nil, errors.New("Domain is not specified")
+	}
+	domains := at.Config.Domains
+	plan := &TlsPlan{Domain: domains[0], Domains: domains, Action: TlsPlanIssue, Reason: "new certificate"}
+
+	exists, err := at.Storage.Exists(context.TODO(), at.getCertFileName(plan.Domain, ".crt"))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		plan.Reason = "replaces stored certificate"
+	}
+	return plan, at.planOrder(plan, at.keyType(), true)
+}
+
+// PlanIssueCsr returns plan of IssueCsr.
+func (at *AutoTls) PlanIssueCsr(csrPem []byte) (*TlsPlan, error) {
+	csr, err := parseCsr(csrPem)
+	if err != nil {
+		return nil, err
+	}
+	domains := csrDomains(csr)
+	plan := &TlsPlan{Domain: domains[0], Domains: domains, Action: TlsPlanIssue, Reason: "new certificate from CSR"}
+	return plan, at.planCsr(plan, true)
+}
+
+// PlanRenew returns plan of Renew, decision is the one Renew makes (see renewDecision).
+func (at *AutoTls) PlanRenew(reuseKey bool) (*TlsPlan, error) {
+	if len(at.Config.Domains) == 0 {
+		return nil, errors.New("Domain is not specified")
+	}
+	domain := at.Config.Domains[0]
+
+	d, err := at.renewDecision(domain)
+	if err != nil {
+		return nil, err
+	}
+	plan := &TlsPlan{Domain: domain, Domains: d.domains, Action: TlsPlanSkip, Reason: d.reason}
+
+	switch {
+	case !d.renew && d.deployPending:
+		plan.Action = TlsPlanDeploy
+		plan.Reason += ", previous deploy failed"
+		at.planDeploy(plan)
+		return plan, nil
+	case !d.renew:
+		return plan, nil
+	case d.csr != nil:
+		plan.Action = TlsPlanRenew
+		plan.Reason += ", stored CSR is re-submitted"
+		return plan, at.planCsr(plan, false)
+	}
+	plan.Action = TlsPlanRenew
+
+	if err = at.planOrder(plan, d.keyType, false); err != nil {
+		return nil, err
+	}
+	if reuseKey && !d.convert {
+		plan.KeyType += " (stored key reused)"
+	}
+	return plan, nil
+}
+
+// PlanRenewAll returns plan of RenewAll, errors of single certificates are kept in TlsPlan.Err.
+func (at *AutoTls) PlanRenewAll() ([]TlsPlan, error) {
+	certs, err := at.List()
+	if err != nil {
+		return nil, err
+	}
+
+	plans := make([]TlsPlan, 0, len(certs))
+	for _, cert := range certs {
+		domains := cert.Domains()
+		if cert.Meta != nil && len(cert.Meta.Domains) > 0 {
+			domains = cert.Meta.Domains
+		}
+		if len(domains) == 0 {
+			plans = append(plans, TlsPlan{Domain: filepath.Base(cert.Path), Err: fmt.Sprintf("Certificate %s has no domains", cert.Path)})
+			continue
+		}
+
+		job := *at
+		job.Config.Domains = domains
+		plan, err := job.PlanRenew(false)
+		if err != nil {
+			plans = append(plans, TlsPlan{Domain: domains[0], Domains: domains, Err: err.Error()})
+			continue
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, nil
+}
+
+// planOrder fills issuer, account, challenge records and storage keys of obtain.
+func (at *AutoTls) planOrder(plan *TlsPlan, keyType certcrypto.KeyType, register bool) error {
+	plan.KeyType = TlsKeyTypeName(keyType)
+	if err := at.planIssuer(plan, register); err != nil {
+		return err
+	}
+
+	order := at.getCertFileName(plan.Domain, ".order")
+	plan.Writes = append(plan.Writes, order)
+	for _, ext := range []string{".json", ".ca", ".crt", ".key"} {
+		plan.Writes = append(plan.Writes, at.getCertFileName(plan.Domain, ext))
+	}
+	plan.Deletes = append(plan.Deletes, order)
+	// CSR of a previous certificate is removed (see saveResource)
+	csr := at.getCertFileName(plan.Domain, ".csr")
+	exists, err := at.Storage.Exists(context.TODO(), csr)
+	if err != nil {
+		return err
+	}
+	if exists {
+		plan.Deletes = append(plan.Deletes, csr)
+	}
+	at.planDeploy(plan)
+	return nil
+}
+
+// planCsr fills the same as planOrder for certificates issued from CSR.
+func (at *AutoTls) planCsr(plan *TlsPlan, register bool) error {
+	plan.KeyType = "kept by the caller"
+	if err := at.planIssuer(plan, register); err != nil {
+		return err
+	}
+	for _, ext := range []string{".json", ".csr", ".ca", ".crt"} {
+		plan.Writes = append(plan.Writes, at.getCertFileName(plan.Domain, ext))
+	}
+	plan.Deletes = append(plan.Deletes, at.getCertFileName(plan.Domain, ".key"))
+	at.planDeploy(plan)
+	return nil
+}
+
+func (at *AutoTls) planIssuer(plan *TlsPlan, register bool) error {
+	if at.Issuer != nil {
+		meta := TlsCertMeta{}
+		at.Issuer.Annotate(&meta)
+		plan.Issuer = strings.TrimSpace(fmt.Sprint(meta.Backend, " ", meta.DirectoryURL))
+		return nil
+	}
+
+	plan.Issuer = fmt.Sprint(TlsIssuerAcme, " ", at.caDirUrl())
+	if err := at.planAccount(plan, register); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, domain := range plan.Domains {
+		var record string
+		switch {
+		case net.ParseIP(domain) != nil && at.challenge() == TlsChallengeDns01:
+			continue
+		case at.challenge() == TlsChallengeDns01:
+			provider := at.dnsProviderName(domain)
+			if provider == "" {
+				provider = "no DNS provider matches"
+			}
+			record = fmt.Sprintf("TXT _acme-challenge.%s (%s)", strings.TrimPrefix(domain, "*."), provider)
+		case at.challenge() == TlsChallengeHttp01:
+			record = fmt.Sprintf("%s %s (%s)", TlsChallengeHttp01, domain, TlsChallengeKey(at.challengePathPrefix(), TlsChallengeHttp01, "<token>"))
+		default:
+			record = fmt.Sprintf("%s %s (%s)", at.challenge(), domain, TlsChallengeKey(at.challengePathPrefix(), at.challenge(), domain))
+		}
+		if !seen[record] {
+			seen[record] = true
+			plan.Records = append(plan.Records, record)
+		}
+	}
+	if at.challenge() == TlsChallengeDns01 {
+		// tracked presented records, see tlsDnsProvider
+		plan.Writes = append(plan.Writes, TlsChallengeKey(at.challengePathPrefix(), TlsChallengeDns01, "<token>.json"))
+		if err := at.planStaleDns(plan); err != nil {
+			return err
+		}
+	}
+	at.planPreflight(plan)
+	return nil
+}
+
+// planPreflight adds probe records created and removed by preflight (see preflightZone).
+func (at *AutoTls) planPreflight(plan *TlsPlan) {
+	if at.Config.SkipPreflight || !at.Config.PreflightProbe || at.challenge() != TlsChallengeDns01 {
+		return
+	}
+	for _, domain := range plan.Domains {
+		if net.ParseIP(domain) == nil && at.dnsProviderName(domain) == "hetzner" {
+			plan.Records = append(plan.Records, fmt.Sprintf("TXT %s in zone of %s (pre-flight probe, removed)",
+				hetznerDnsProbeRecord, preflightAscii(strings.TrimPrefix(domain, "*."))))
+		}
+	}
+}
+
+// planStaleDns adds tracked records left behind by failed runs,
+// they are removed when domains are presented (see tlsDnsProvider.cleanStale).
+func (at *AutoTls) planStaleDns(plan *TlsPlan) error {
+	keys, err := at.Storage.Find(context.TODO(), TlsChallengeKey(at.challengePathPrefix(), TlsChallengeDns01, ""), ".json")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var rec tlsDnsRecord
+		if _, err := at.readJson(key, &rec); err != nil {
+			// unreadable records are kept by cleanStale
+			continue
+		}
+		if rec.stale() {
+			plan.Records = append(plan.Records, fmt.Sprintf("remove stale TXT _acme-challenge.%s (left since %s)",
+				rec.Domain, rec.Created.Format(time.RFC3339)))
+			plan.Deletes = append(plan.Deletes, key)
+		}
+	}
+	return nil
+}
+
+// planAccount reads account from storage only (loadUser may contact the CA).
+func (at *AutoTls) planAccount(plan *TlsPlan, register bool) error {
+	jsonKey := at.accountFilePath()
+	keyKey := at.accountFileName(at.Config.Email, ".key")
+	stems, err := at.accountLegacyStems()
+	if err != nil {
+		return err
+	}
+	for _, stem := range stems {
+		for _, key := range []string{jsonKey, keyKey} {
+			legacy := stem + filepath.Ext(key)
+			exists, err := at.AccountStorage.Exists(context.TODO(), legacy)
+			if err != nil {
+				return err
+			}
+			if exists {
+				plan.Writes = append(plan.Writes, key)
+				plan.Deletes = append(plan.Deletes, legacy)
+			}
+		}
+	}
+
+	var user AcmeUser
+	exists, err := at.AccountStorage.Exists(context.TODO(), jsonKey)
+	if err != nil {
+		return err
+	}
+	if exists {
+		b, err := at.AccountStorage.Read(context.TODO(), jsonKey)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(b, &user); err != nil {
+			return fmt.Errorf("Invalid %s: %w", jsonKey, err)
+		}
+	}
+
+	switch {
+	case user.Registration != nil && user.Registration.Body.Status == tlsAccountDeactivated:
+		return fmt.Errorf("Account %s is deactivated", user.Registration.URI)
+	case user.Registration != nil:
+		plan.Account = fmt.Sprintf("use %s (%s)", user.Registration.URI, at.Config.Email)
+	case exists:
+		plan.Account = fmt.Sprintf("recover registration of %s", at.Config.Email)
+		plan.Writes = append(plan.Writes, jsonKey)
+	case !register:
+		return errors.New("Account is not registered. Issue new certificate.")
+	default:
+		plan.Account = fmt.Sprintf("register %s", at.Config.Email)
+		hasKey, err := at.AccountStorage.Exists(context.TODO(), keyKey)
+		if err != nil {
+			return err
+		}
+		if !hasKey {
+			plan.Writes = append(plan.Writes, keyKey)
+		}
+		plan.Writes = append(plan.Writes, jsonKey)
+	}
+	return nil
+}
+
+func (at *AutoTls) planDeploy(plan *TlsPlan) {
+	for _, t := range at.Config.Deploy[plan.Domain] {
+		for _, path := range []string{t.Path, t.KeyPath, t.ChainPath} {
+			if path != "" {
+				plan.Deploy = append(plan.Deploy, fmt.Sprintf("%s (%s)", path, t.Format))
+			}
+		}
+	}
+}
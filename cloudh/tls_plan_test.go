@@ -0,0 +1,126 @@
+package cloudh
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+func TestPlanRenew(t *testing.T) {
+	days := func(d int) *int { return &d }
+
+	tests := []struct {
+		name        string
+		config      TlsConfig
+		deployError string
+		action      string
+		reason      string
+	}{
+		{name: "not due", action: TlsPlanSkip, reason: "renew within 30 days"},
+		{name: "due", config: TlsConfig{RenewDays: days(100)}, action: TlsPlanRenew, reason: "renew within 100 days"},
+		{name: "always", config: TlsConfig{RenewDays: days(-1)}, action: TlsPlanRenew},
+		{name: "deploy failed", deployError: "hook failed", action: TlsPlanDeploy, reason: "previous deploy failed"},
+		{name: "due with deploy failed", config: TlsConfig{RenewDays: days(100)}, deployError: "hook failed", action: TlsPlanRenew},
+		{name: "key type", config: TlsConfig{KeyType: certcrypto.RSA2048}, action: TlsPlanRenew, reason: "key type changes from ec256 to rsa2048"},
+		{
+			name:   "domains merged",
+			config: TlsConfig{Domains: []string{"a.com", "b.com"}, DomainsChanged: TlsDomainsMerge},
+			action: TlsPlanRenew,
+			reason: "SANs change (added: b.com)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := &AutoTls{Config: tt.config, Storage: &TlsFileStorage{}, Issuer: &TlsVaultPkiIssuer{Role: "web"}}
+			at.Config.CertPathPrefix = t.TempDir()
+			if len(at.Config.Domains) == 0 {
+				at.Config.Domains = []string{"a.com"}
+			}
+			testStoreCertificate(t, at, "a.com", tt.deployError)
+
+			plan, err := at.PlanRenew(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.Action != tt.action || !strings.Contains(plan.Reason, tt.reason) {
+				t.Errorf("PlanRenew() = %s: %s, want %s: %s", plan.Action, plan.Reason, tt.action, tt.reason)
+			}
+
+			// RenewAll schedules the same certificates
+			d, err := at.renewDecision("a.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scheduled := d.renew || d.deployPending; scheduled != (tt.action != TlsPlanSkip) {
+				t.Errorf("renewDecision() scheduled = %v, plan action %s", scheduled, plan.Action)
+			}
+		})
+	}
+}
+
+func TestPlanStaleDnsRecords(t *testing.T) {
+	dir, renewDays := t.TempDir(), 100
+	at := &AutoTls{
+		Config: TlsConfig{
+			Domains:           []string{"*.a.com"},
+			Email:             "ops@example.com",
+			CertPathPrefix:    filepath.Join(dir, "tls"),
+			AccountPathPrefix: filepath.Join(dir, "acc"),
+			DnsToken:          "token",
+			PreflightProbe:    true,
+			RenewDays:         &renewDays,
+		},
+		Storage:        &TlsFileStorage{},
+		AccountStorage: &TlsFileStorage{},
+	}
+	testStoreCertificate(t, at, "*.a.com", "")
+
+	b, _ := json.Marshal(AcmeUser{Email: at.Config.Email, Registration: &registration.Resource{URI: "https://ca/acct/1"}})
+	if err := at.AccountStorage.Write(context.Background(), at.accountFilePath(), b); err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]tlsDnsRecord{
+		"same.json":  {Domain: "a.com", Token: "same", Created: time.Now()},
+		"other.json": {Domain: "b.com", Token: "other", Created: time.Now()},
+		"old.json":   {Domain: "b.com", Token: "old", Created: time.Now().Add(-2 * tlsDnsStaleAge)},
+	}
+	for name, rec := range records {
+		b, _ := json.Marshal(rec)
+		if err := at.Storage.Write(context.Background(), TlsChallengeKey(at.challengePathPrefix(), TlsChallengeDns01, name), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan, err := at.PlanRenew(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletes := strings.Join(plan.Deletes, " ")
+	// fresh record of the same name may belong to another certificate being ordered
+	for name, want := range map[string]bool{"same.json": false, "other.json": false, "old.json": true} {
+		if got := strings.Contains(deletes, name); got != want {
+			t.Errorf("plan deletes %s = %v, want %v (%v)", name, got, want, plan.Deletes)
+		}
+	}
+	if !strings.Contains(strings.Join(plan.Records, " "), "TXT _owl-preflight in zone of a.com") {
+		t.Errorf("plan records = %v, want pre-flight probe", plan.Records)
+	}
+}
+
+// testStoreCertificate writes self-signed certificate, key and metadata of domain.
+func testStoreCertificate(t *testing.T, at *AutoTls, domain, deployError string) {
+	t.Helper()
+	crt, key := testCertificate(t, domain)
+	meta, _ := json.Marshal(TlsCertMeta{Domains: []string{domain}, DeployError: deployError})
+	for ext, b := range map[string][]byte{".crt": crt, ".key": key, ".json": meta} {
+		if err := at.Storage.Write(context.Background(), at.getCertFileName(domain, ext), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package cloudh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/imroc/req"
+	"github.com/miekg/dns"
+	"github.com/qbart/ohowl/tea"
+	"golang.org/x/net/idna"
+)
+
+const (
+	TlsPreflightIdna = "idna"
+	TlsPreflightCaa  = "caa"
+	TlsPreflightZone = "zone"
+
+	TlsPreflightOk      = "ok"
+	TlsPreflightFailed  = "failed"
+	TlsPreflightSkipped = "skipped"
+)
+
+const (
+	hetznerDnsApiBase     = "https://dns.hetzner.com/api/v1"
+	hetznerDnsProbeRecord = "_owl-preflight"
+)
+
+// ErrTlsPreflight is returned when any pre-flight check fails.
+var ErrTlsPreflight = errors.New("Pre-flight checks failed")
+
+// tlsCaaIdentities maps ACME directory host to CAA issuer domain of the CA.
+var tlsCaaIdentities = map[string]string{
+	"letsencrypt.org": "letsencrypt.org",
+	"buypass.com":     "buypass.com",
+	"zerossl.com":     "sectigo.com",
+}
+
+type TlsPreflightResult struct {
+	Domain  string `json:"domain"`
+	Check   string `json:"check"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type hetznerDnsZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type hetznerDnsRecord struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Preflight checks domains before ordering: IDNA form, CAA records allowing
+// the CA and (for Hetzner DNS-01) that the DNS token can edit the zone.
+// Error wraps ErrTlsPreflight when any check failed.
+func (at *AutoTls) Preflight(domains []string) ([]TlsPreflightResult, error) {
+	results := make([]TlsPreflightResult, 0, 3*len(domains))
+	zones := make(map[string]error)
+	failed := make([]string, 0)
+
+	for _, domain := range domains {
+		// CAA and zone are checked for the A-label form ordered from the CA
+		ascii := preflightAscii(domain)
+		checks := []struct {
+			name string
+			fn   func(string) (string, string)
+		}{
+			{TlsPreflightIdna, func(string) (string, string) { return preflightIdna(domain) }},
+			{TlsPreflightCaa, at.preflightCaa},
+			{TlsPreflightZone, func(d string) (string, string) { return at.preflightZone(d, zones) }},
+		}
+		for _, c := range checks {
+			status, msg := c.fn(ascii)
+			results = append(results, TlsPreflightResult{Domain: domain, Check: c.name, Status: status, Message: msg})
+			if status == TlsPreflightFailed {
+				failed = append(failed, fmt.Sprintf("%s %s: %s", domain, c.name, msg))
+			}
+			// other checks make no sense for malformed domain
+			if c.name == TlsPreflightIdna && status == TlsPreflightFailed {
+				break
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("%w: %s", ErrTlsPreflight, strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+// preflightAscii returns domain in A-label form (unchanged when conversion fails).
+func preflightAscii(domain string) string {
+	name := strings.TrimPrefix(domain, "*.")
+	ascii, err := idna.Lookup.ToASCII(strings.ToLower(name))
+	if err != nil || net.ParseIP(domain) != nil {
+		return domain
+	}
+	return strings.TrimSuffix(domain, name) + ascii
+}
+
+// preflightIdna validates A-label form of domain, U-labels are accepted
+// (the CA is given the A-label form).
+func preflightIdna(domain string) (string, string) {
+	if net.ParseIP(domain) != nil {
+		return TlsPreflightOk, "IP address"
+	}
+
+	name := strings.TrimPrefix(domain, "*.")
+	ascii, err := idna.Lookup.ToASCII(strings.ToLower(name))
+	if err != nil {
+		return TlsPreflightFailed, err.Error()
+	}
+	// A-labels given directly must decode to valid U-labels
+	if _, err = idna.Lookup.ToUnicode(ascii); err != nil {
+		return TlsPreflightFailed, err.Error()
+	}
+	if len(ascii) > 253 {
+		return TlsPreflightFailed, "name longer than 253 characters"
+	}
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return TlsPreflightFailed, "name must have at least two labels"
+	}
+	for _, label := range labels {
+		if err := validDnsLabel(label); err != nil {
+			return TlsPreflightFailed, fmt.Sprintf("label %q %v", label, err)
+		}
+	}
+	if ascii != strings.ToLower(name) {
+		return TlsPreflightOk, fmt.Sprintf("ordered as %s", strings.TrimSuffix(domain, name)+ascii)
+	}
+	return TlsPreflightOk, ""
+}
+
+func validDnsLabel(label string) error {
+	if len(label) == 0 || len(label) > 63 {
+		return errors.New("must have 1-63 characters")
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return errors.New("must not start or end with hyphen")
+	}
+	for _, r := range label {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return fmt.Errorf("contains invalid character %q", r)
+		}
+	}
+	return nil
+}
+
+// preflightCaa follows RFC 8659: the closest non-empty CAA set up the tree is relevant.
+func (at *AutoTls) preflightCaa(domain string) (string, string) {
+	if at.Issuer != nil {
+		return TlsPreflightSkipped, "not an ACME issuer"
+	}
+	if net.ParseIP(domain) != nil {
+		return TlsPreflightSkipped, "IP address"
+	}
+	identity := at.caaIdentity()
+	if identity == "" {
+		return TlsPreflightSkipped, fmt.Sprintf("CAA identity of %s is unknown", at.Config.AcmeDirectory)
+	}
+
+	wildcard := strings.HasPrefix(domain, "*.")
+	name := strings.TrimPrefix(domain, "*.")
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		fqdn := dns01.ToFqdn(strings.Join(labels[i:], "."))
+		records, err := lookupCaa(fqdn, at.dnsResolvers())
+		if err != nil {
+			return TlsPreflightFailed, err.Error()
+		}
+		if len(records) == 0 {
+			continue
+		}
+		return checkCaa(records, dns01.UnFqdn(fqdn), identity, wildcard)
+	}
+	return TlsPreflightOk, "no CAA records"
+}
+
+func (at *AutoTls) caaIdentity() string {
+	directory := at.Config.AcmeDirectory
+	if directory == "" {
+		return "letsencrypt.org"
+	}
+	for host, identity := range tlsCaaIdentities {
+		if strings.Contains(directory, host) {
+			return identity
+		}
+	}
+	return ""
+}
+
+// dnsResolvers returns Config.Dns.Resolvers, nameservers of resolv.conf otherwise.
+func (at *AutoTls) dnsResolvers() []string {
+	if len(at.Config.Dns.Resolvers) > 0 {
+		return dns01.ParseNameservers(at.Config.Dns.Resolvers)
+	}
+	if config, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil && len(config.Servers) > 0 {
+		return dns01.ParseNameservers(config.Servers)
+	}
+	return []string{"8.8.8.8:53", "8.8.4.4:53"}
+}
+
+func checkCaa(records []*dns.CAA, owner, identity string, wildcard bool) (string, string) {
+	issue := make([]string, 0)
+	issueWild := make([]string, 0)
+	for _, r := range records {
+		value := strings.TrimSpace(strings.SplitN(r.Value, ";", 2)[0])
+		switch strings.ToLower(r.Tag) {
+		case "issue":
+			issue = append(issue, value)
+		case "issuewild":
+			issueWild = append(issueWild, value)
+		case "iodef":
+		default:
+			if r.Flag&128 != 0 {
+				return TlsPreflightFailed, fmt.Sprintf("unknown critical CAA tag %s at %s", r.Tag, owner)
+			}
+		}
+	}
+
+	allowed := issue
+	if wildcard && len(issueWild) > 0 {
+		allowed = issueWild
+	}
+	if len(allowed) == 0 {
+		return TlsPreflightOk, fmt.Sprintf("no issue restrictions at %s", owner)
+	}
+	issuers := make([]string, 0, len(allowed))
+	for _, value := range allowed {
+		if strings.EqualFold(value, identity) {
+			return TlsPreflightOk, fmt.Sprintf("%s allowed at %s", identity, owner)
+		}
+		// empty value (";") forbids issuance
+		if value != "" {
+			issuers = append(issuers, value)
+		}
+	}
+	if len(issuers) == 0 {
+		return TlsPreflightFailed, fmt.Sprintf("CAA at %s forbids issuance", owner)
+	}
+	return TlsPreflightFailed, fmt.Sprintf("CAA at %s allows only: %s", owner, strings.Join(issuers, ", "))
+}
+
+func lookupCaa(fqdn string, nameservers []string) ([]*dns.CAA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeCAA)
+	m.RecursionDesired = true
+
+	var lastErr error
+	client := dns.Client{Timeout: 10 * time.Second}
+	for _, ns := range nameservers {
+		r, _, err := client.Exchange(m, ns)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch r.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+		default:
+			// CA treats lookup failure as denial
+			return nil, fmt.Errorf("CAA lookup of %s failed: %s", fqdn, dns.RcodeToString[r.Rcode])
+		}
+
+		records := make([]*dns.CAA, 0)
+		for _, rr := range r.Answer {
+			if caa, ok := rr.(*dns.CAA); ok {
+				records = append(records, caa)
+			}
+		}
+		return records, nil
+	}
+	return nil, fmt.Errorf("CAA lookup of %s failed: %w", fqdn, lastErr)
+}
+
+// lookupTxt reports whether every nameserver returns value among TXT records of fqdn.
+func lookupTxt(fqdn, value string, nameservers []string) (bool, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeTXT)
+	m.RecursionDesired = true
+
+	client := dns.Client{Timeout: 10 * time.Second}
+	for _, ns := range nameservers {
+		r, _, err := client.Exchange(m, ns)
+		if err != nil {
+			return false, err
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			return false, fmt.Errorf("%s returned %s for %s", ns, dns.RcodeToString[r.Rcode], fqdn)
+		}
+		found := false
+		for _, rr := range r.Answer {
+			if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("%s did not return the expected TXT record for %s", ns, fqdn)
+		}
+	}
+	return true, nil
+}
+
+// preflightZone checks the Hetzner zone of domain is visible to the DNS token
+// (tokens are not scoped), with Config.PreflightProbe a probe TXT record is created
+// and removed in the zone. Probe results are cached by zone.
+func (at *AutoTls) preflightZone(domain string, zones map[string]error) (string, string) {
+	if at.Issuer != nil || at.challenge() != TlsChallengeDns01 {
+		return TlsPreflightSkipped, "no DNS-01 challenge"
+	}
+	if net.ParseIP(domain) != nil {
+		return TlsPreflightSkipped, "IP address"
+	}
+	name := at.dnsProviderName(domain)
+	if name == "" {
+		return TlsPreflightFailed, "no DNS provider matches domain"
+	}
+	if name != "hetzner" {
+		return TlsPreflightSkipped, fmt.Sprintf("DNS provider %s", name)
+	}
+	token := at.Config.DnsToken
+	if token == "" {
+		token = os.Getenv("HETZNER_API_KEY")
+	}
+
+	zone, err := hetznerDnsFindZone(token, strings.TrimPrefix(strings.ToLower(domain), "*."))
+	if err != nil {
+		return TlsPreflightFailed, err.Error()
+	}
+	if !at.Config.PreflightProbe {
+		return TlsPreflightOk, fmt.Sprintf("zone %s", zone.Name)
+	}
+	if _, ok := zones[zone.ID]; !ok {
+		zones[zone.ID] = hetznerDnsProbe(token, zone)
+	}
+	if err := zones[zone.ID]; err != nil {
+		return TlsPreflightFailed, fmt.Sprintf("zone %s is not editable: %v", zone.Name, err)
+	}
+	return TlsPreflightOk, fmt.Sprintf("zone %s", zone.Name)
+}
+
+// hetznerDnsFindZone returns the longest zone containing name.
+func hetznerDnsFindZone(token, name string) (*hetznerDnsZone, error) {
+	labels := strings.Split(name, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		var res struct {
+			Zones []hetznerDnsZone `json:"zones"`
+		}
+		r := tea.HttpGet(context.TODO(), fmt.Sprint(hetznerDnsApiBase, "/zones"),
+			req.Header{"Auth-API-Token": token}, req.Param{"name": strings.Join(labels[i:], ".")})
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		switch code := r.Resp.Response().StatusCode; code {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			continue
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return nil, errors.New("DNS token was rejected")
+		default:
+			return nil, fmt.Errorf("Hetzner DNS API returned %d", code)
+		}
+		if r.ToJSON(&res).Err != nil {
+			return nil, r.Err
+		}
+		if len(res.Zones) > 0 {
+			return &res.Zones[0], nil
+		}
+	}
+	return nil, fmt.Errorf("no zone for %s is visible to DNS token", name)
+}
+
+// hetznerDnsProbe creates and removes _owl-preflight TXT record in zone,
+// probe records left behind by previous runs are removed first.
+func hetznerDnsProbe(token string, zone *hetznerDnsZone) error {
+	var records struct {
+		Records []hetznerDnsRecord `json:"records"`
+	}
+	r := tea.HttpGet(context.TODO(), fmt.Sprint(hetznerDnsApiBase, "/records"),
+		req.Header{"Auth-API-Token": token}, req.Param{"zone_id": zone.ID})
+	if r.Err != nil {
+		return r.Err
+	}
+	if code := r.Resp.Response().StatusCode; code != http.StatusOK {
+		return fmt.Errorf("listing records returned %d", code)
+	}
+	if r.ToJSON(&records).Err != nil {
+		return r.Err
+	}
+	for _, record := range records.Records {
+		if record.Name != hetznerDnsProbeRecord {
+			continue
+		}
+		if err := hetznerDnsDeleteRecord(token, record.ID); err != nil {
+			return err
+		}
+	}
+
+	var res struct {
+		Record hetznerDnsRecord `json:"record"`
+	}
+	r = tea.HttpPost(context.TODO(), fmt.Sprint(hetznerDnsApiBase, "/records"),
+		req.Header{"Auth-API-Token": token},
+		req.BodyJSON(map[string]interface{}{
+			"zone_id": zone.ID,
+			"type":    "TXT",
+			"name":    hetznerDnsProbeRecord,
+			"value":   fmt.Sprint(time.Now().Unix()),
+			"ttl":     60,
+		}))
+	if r.Err != nil {
+		return r.Err
+	}
+	if code := r.Resp.Response().StatusCode; code != http.StatusOK && code != http.StatusCreated {
+		return fmt.Errorf("creating record returned %d", code)
+	}
+	if r.ToJSON(&res).Err != nil {
+		return r.Err
+	}
+
+	return hetznerDnsDeleteRecord(token, res.Record.ID)
+}
+
+func hetznerDnsDeleteRecord(token, id string) error {
+	r := tea.HttpDelete(context.TODO(), fmt.Sprint(hetznerDnsApiBase, "/records/", id),
+		req.Header{"Auth-API-Token": token})
+	if r.Err != nil {
+		return r.Err
+	}
+	if code := r.Resp.Response().StatusCode; code != http.StatusOK {
+		return fmt.Errorf("deleting probe record %s returned %d", id, code)
+	}
+	return nil
+}
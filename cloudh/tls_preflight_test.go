@@ -0,0 +1,83 @@
+package cloudh
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckCaa(t *testing.T) {
+	caa := func(flag uint8, tag, value string) *dns.CAA {
+		return &dns.CAA{Flag: flag, Tag: tag, Value: value}
+	}
+	tests := []struct {
+		name     string
+		records  []*dns.CAA
+		wildcard bool
+		want     string
+	}{
+		{name: "allowed", records: []*dns.CAA{caa(0, "issue", "letsencrypt.org")}, want: TlsPreflightOk},
+		{name: "allowed with parameters", records: []*dns.CAA{caa(0, "issue", "letsencrypt.org; validationmethods=dns-01")}, want: TlsPreflightOk},
+		{name: "case insensitive", records: []*dns.CAA{caa(0, "ISSUE", "LetsEncrypt.org")}, want: TlsPreflightOk},
+		{name: "other CA", records: []*dns.CAA{caa(0, "issue", "sectigo.com")}, want: TlsPreflightFailed},
+		{name: "one of many", records: []*dns.CAA{caa(0, "issue", "sectigo.com"), caa(0, "issue", "letsencrypt.org")}, want: TlsPreflightOk},
+		{name: "forbidden", records: []*dns.CAA{caa(0, "issue", ";")}, want: TlsPreflightFailed},
+		{name: "iodef only", records: []*dns.CAA{caa(0, "iodef", "mailto:ops@a.com")}, want: TlsPreflightOk},
+		{name: "unknown tag", records: []*dns.CAA{caa(0, "future", "x"), caa(0, "issue", "letsencrypt.org")}, want: TlsPreflightOk},
+		{name: "unknown critical tag", records: []*dns.CAA{caa(128, "future", "x"), caa(0, "issue", "letsencrypt.org")}, want: TlsPreflightFailed},
+		{
+			name:     "issuewild overrides issue for wildcard",
+			records:  []*dns.CAA{caa(0, "issue", "letsencrypt.org"), caa(0, "issuewild", "sectigo.com")},
+			wildcard: true,
+			want:     TlsPreflightFailed,
+		},
+		{
+			name:    "issuewild ignored for non-wildcard",
+			records: []*dns.CAA{caa(0, "issue", "letsencrypt.org"), caa(0, "issuewild", ";")},
+			want:    TlsPreflightOk,
+		},
+		{
+			name:     "issue applies to wildcard without issuewild",
+			records:  []*dns.CAA{caa(0, "issue", "sectigo.com")},
+			wildcard: true,
+			want:     TlsPreflightFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, msg := checkCaa(tt.records, "a.com", "letsencrypt.org", tt.wildcard); got != tt.want {
+				t.Errorf("checkCaa() = %s (%s), want %s", got, msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreflightIdna(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+		ascii  string
+	}{
+		{domain: "a.com", want: TlsPreflightOk, ascii: "a.com"},
+		{domain: "*.a.com", want: TlsPreflightOk, ascii: "*.a.com"},
+		{domain: "bücher.de", want: TlsPreflightOk, ascii: "xn--bcher-kva.de"},
+		{domain: "*.bücher.de", want: TlsPreflightOk, ascii: "*.xn--bcher-kva.de"},
+		{domain: "xn--bcher-kva.de", want: TlsPreflightOk, ascii: "xn--bcher-kva.de"},
+		{domain: "10.0.0.1", want: TlsPreflightOk, ascii: "10.0.0.1"},
+		{domain: "com", want: TlsPreflightFailed},
+		{domain: "-a.com", want: TlsPreflightFailed},
+		{domain: "a_b.com", want: TlsPreflightFailed},
+		{domain: "xn--zz.com", want: TlsPreflightFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got, msg := preflightIdna(tt.domain)
+			if got != tt.want {
+				t.Fatalf("preflightIdna(%s) = %s (%s), want %s", tt.domain, got, msg, tt.want)
+			}
+			if tt.want == TlsPreflightOk && preflightAscii(tt.domain) != tt.ascii {
+				t.Errorf("preflightAscii(%s) = %s, want %s", tt.domain, preflightAscii(tt.domain), tt.ascii)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package cloudh
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// ErrTlsWatchUnsupported is returned by TlsWatcher decorators
+// when the underlying storage can't be watched.
+var ErrTlsWatchUnsupported = errors.New("Storage does not support watching")
+
+const tlsWatchWaitTime = 5 * time.Minute
+
+// TlsWatcher is implemented by storages that can block until any key under
+// prefix changes. Watch returns new index to pass to the next call.
+type TlsWatcher interface {
+	Watch(ctx context.Context, prefix string, index uint64) (uint64, error)
+}
+
+// TlsSync mirrors certificates from Tls.Storage into local Dir.
+type TlsSync struct {
+	Tls      *AutoTls
+	Local    *TlsFileStorage
+	Dir      string
+	Domains  []string      // every stored certificate when empty
+	Hook     string        // run with sh -c when any file changed
+	Interval time.Duration // polling interval for storages without TlsWatcher
+}
+
+// Sync copies key/crt/ca of each domain into Dir (only files which content changed)
+// and runs Hook when anything changed. Returns changed domains.
+// Domains whose key does not match the certificate are not written.
+func (s *TlsSync) Sync(ctx context.Context) ([]string, error) {
+	domains, err := s.domains(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0)
+	var errs []error
+	for _, domain := range domains {
+		ok, err := s.syncDomain(ctx, domain)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			log.Printf("[%s] Synced to %s", domain, s.Dir)
+			changed = append(changed, domain)
+		}
+	}
+
+	if len(changed) > 0 && s.Hook != "" {
+		err := runTlsHook(s.Hook,
+			"OWL_DOMAINS="+strings.Join(changed, ","),
+			"OWL_SYNC_DIR="+s.Dir,
+		)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Sync hook failed: %w", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return changed, fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	return changed, nil
+}
+
+// Watch syncs whenever storage changes (Consul blocking queries) or every Interval
+// for other storages, until ctx is done. Errors are logged and retried.
+func (s *TlsSync) Watch(ctx context.Context) error {
+	watcher, ok := s.Tls.Storage.(TlsWatcher)
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	var index uint64
+	for {
+		if ok {
+			next, err := watcher.Watch(ctx, s.Tls.Config.CertPathPrefix, index)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err == ErrTlsWatchUnsupported {
+				ok = false
+				continue
+			}
+			if err != nil {
+				log.Printf("Watch failed: %v", err)
+				if !sleepContext(ctx, interval) {
+					return nil
+				}
+				continue
+			}
+			if index != 0 && next == index {
+				continue
+			}
+			// index may go backwards after Consul snapshot restore
+			if next < index {
+				next = 0
+			}
+			index = next
+		}
+
+		if _, err := s.Sync(ctx); err != nil {
+			log.Println(err)
+		}
+
+		if !ok && !sleepContext(ctx, interval) {
+			return nil
+		}
+	}
+}
+
+func (s *TlsSync) domains(ctx context.Context) ([]string, error) {
+	if len(s.Domains) > 0 {
+		return s.Domains, nil
+	}
+	matches, err := s.Tls.Storage.Find(ctx, s.Tls.Config.CertPathPrefix, ".crt")
+	if err != nil {
+		return nil, err
+	}
+	// file stems work as domains (getCertFileName keeps them as is)
+	domains := make([]string, 0, len(matches))
+	for _, m := range matches {
+		domains = append(domains, strings.TrimSuffix(filepath.Base(m), ".crt"))
+	}
+	return domains, nil
+}
+
+func (s *TlsSync) syncDomain(ctx context.Context, domain string) (bool, error) {
+	// certificates issued from CSR have no key stored
+	csr, err := s.Tls.Storage.Exists(ctx, s.Tls.getCertFileName(domain, ".csr"))
+	if err != nil {
+		return false, err
+	}
+
+	files := make(map[string][]byte)
+	for _, ext := range []string{".key", ".crt", ".ca"} {
+		key := s.Tls.getCertFileName(domain, ext)
+		if ext == ".ca" || (ext == ".key" && csr) {
+			ok, err := s.Tls.Storage.Exists(ctx, key)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		b, err := s.Tls.Storage.Read(ctx, key)
+		if err != nil {
+			return false, fmt.Errorf("[%s] Error while reading %s: %w", domain, key, err)
+		}
+		files[ext] = b
+	}
+
+	if keyPem, ok := files[".key"]; ok {
+		if _, err := tls.X509KeyPair(files[".crt"], keyPem); err != nil {
+			return false, fmt.Errorf("[%s] Private key does not match certificate: %w", domain, err)
+		}
+	}
+
+	stem := filepath.Join(s.Dir, filepath.Base(s.Tls.getCertFileName(domain, "")))
+	changed := false
+	for ext, b := range files {
+		if current, err := ioutil.ReadFile(stem + ext); err != nil || tlsChecksum(current) != tlsChecksum(b) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	// key/crt/ca are switched together, readers never see a mismatched pair
+	if err := s.Local.WriteBundle(ctx, stem, files); err != nil {
+		return false, fmt.Errorf("[%s] Error while writing %s: %w", domain, s.Dir, err)
+	}
+	return true, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// ----- TlsConsulStorage -----
+
+func (fs *TlsConsulStorage) Watch(ctx context.Context, prefix string, index uint64) (uint64, error) {
+	opts := &consulapi.QueryOptions{WaitIndex: index, WaitTime: tlsWatchWaitTime}
+	_, meta, err := fs.KV.List(fmt.Sprint(prefix, "/"), opts.WithContext(ctx))
+	if err != nil {
+		return index, err
+	}
+	return meta.LastIndex, nil
+}
+
+// ----- TlsEncryptedStorage -----
+
+func (es *TlsEncryptedStorage) Watch(ctx context.Context, prefix string, index uint64) (uint64, error) {
+	if watcher, ok := es.Storage.(TlsWatcher); ok {
+		return watcher.Watch(ctx, prefix, index)
+	}
+	return index, ErrTlsWatchUnsupported
+}
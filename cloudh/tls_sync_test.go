@@ -0,0 +1,55 @@
+package cloudh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTlsSyncWritesBundle(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	at := &AutoTls{Config: TlsConfig{CertPathPrefix: src}, Storage: &TlsFileStorage{}}
+	crt, key := testCertificate(t, "a.com")
+	for ext, b := range map[string][]byte{".crt": crt, ".key": key, ".ca": crt} {
+		if err := ioutil.WriteFile(at.getCertFileName("a.com", ext), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := &TlsSync{Tls: at, Local: &TlsFileStorage{}, Dir: dst}
+
+	changed, err := sync.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "a.com" {
+		t.Fatalf("Sync() = %v, want [a.com]", changed)
+	}
+
+	// every file points into the same bundle version
+	var version string
+	for _, ext := range []string{".crt", ".key", ".ca"} {
+		name := filepath.Join(dst, "a.com"+ext)
+		resolved, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := filepath.Dir(resolved); version == "" {
+			version = v
+		} else if v != version {
+			t.Errorf("%s resolves to %s, want file in %s", name, resolved, version)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(dst, "a.com.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("key mode = %o, want 600", fi.Mode().Perm())
+	}
+
+	if changed, err = sync.Sync(context.Background()); err != nil || len(changed) != 0 {
+		t.Errorf("second Sync() = %v, %v, want nothing changed", changed, err)
+	}
+}
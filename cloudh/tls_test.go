@@ -0,0 +1,57 @@
+package cloudh
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testReadStorage records keys read from file storage.
+type testReadStorage struct {
+	TlsFileStorage
+	reads []string
+}
+
+func (rs *testReadStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	rs.reads = append(rs.reads, key)
+	return rs.TlsFileStorage.Read(ctx, key)
+}
+
+func TestTlsListReadsKeysOnlyOnCheck(t *testing.T) {
+	storage := &testReadStorage{}
+	at := &AutoTls{Config: TlsConfig{CertPathPrefix: t.TempDir()}, Storage: storage}
+	crt, key := testCertificate(t, "a.com")
+	other, _ := testCertificate(t, "b.com")
+	_, otherKey := testCertificate(t, "b.com")
+	for name, b := range map[string][]byte{"a.com.crt": crt, "a.com.key": key, "b.com.crt": other, "b.com.key": otherKey} {
+		if err := ioutil.WriteFile(filepath.Join(at.Config.CertPathPrefix, name), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certs, err := at.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range storage.reads {
+		if strings.HasSuffix(key, ".key") {
+			t.Errorf("List() read %s", key)
+		}
+	}
+	for _, cert := range certs {
+		if cert.KeyMatch != nil {
+			t.Errorf("List() set KeyMatch of %s", cert.CommonName)
+		}
+	}
+
+	if err = at.CheckKeys(certs); err != nil {
+		t.Fatal(err)
+	}
+	for _, cert := range certs {
+		if cert.KeyMatch == nil || *cert.KeyMatch != (cert.CommonName == "a.com") {
+			t.Errorf("CheckKeys() KeyMatch of %s = %v", cert.CommonName, cert.KeyMatch)
+		}
+	}
+}
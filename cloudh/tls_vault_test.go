@@ -0,0 +1,180 @@
+package cloudh
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// testVaultKv serves KV secrets engine of given version mounted at "secret",
+// secrets are kept in the returned map by key (without data/ or metadata/).
+func testVaultKv(t *testing.T, version int) (*vaultapi.Logical, map[string]map[string]interface{}) {
+	t.Helper()
+	secrets := make(map[string]map[string]interface{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/secret/")
+		sub := ""
+		if version == 2 {
+			parts := strings.SplitN(key, "/", 2)
+			if len(parts) != 2 {
+				http.NotFound(w, r)
+				return
+			}
+			sub, key = parts[0], parts[1]
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("list") == "true" && (version == 1 || sub == "metadata"):
+			prefix := strings.TrimSuffix(key, "/") + "/"
+			seen := make(map[string]bool)
+			keys := make([]interface{}, 0)
+			for k := range secrets {
+				if !strings.HasPrefix(k, prefix) {
+					continue
+				}
+				name := strings.TrimPrefix(k, prefix)
+				if i := strings.Index(name, "/"); i >= 0 {
+					name = name[:i+1]
+				}
+				if !seen[name] {
+					seen[name] = true
+					keys = append(keys, name)
+				}
+			}
+			if len(keys) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+
+		case r.Method == http.MethodGet && (version == 1 || sub == "data"):
+			data, ok := secrets[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+				return
+			}
+			if version == 2 {
+				data = map[string]interface{}{"data": data, "metadata": map[string]interface{}{"version": 1}}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+
+		case r.Method == http.MethodPut && (version == 1 || sub == "data"):
+			var data map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if version == 2 {
+				inner, ok := data["data"].(map[string]interface{})
+				if !ok {
+					http.Error(w, "missing data", http.StatusBadRequest)
+					return
+				}
+				data = inner
+			}
+			secrets[key] = data
+			w.WriteHeader(http.StatusNoContent)
+
+		case r.Method == http.MethodDelete && (version == 1 || sub == "metadata"):
+			delete(secrets, key)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "unsupported "+r.Method+" "+r.URL.Path, http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := vaultapi.NewClient(&vaultapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("test")
+	return client.Logical(), secrets
+}
+
+func TestTlsVaultStoragePaths(t *testing.T) {
+	tests := []struct {
+		version  int
+		data     string
+		metadata string
+	}{
+		{version: 1, data: "secret/tls/a.com.crt", metadata: "secret/tls/a.com.crt"},
+		{version: 2, data: "secret/data/tls/a.com.crt", metadata: "secret/metadata/tls/a.com.crt"},
+	}
+	for _, tt := range tests {
+		fs := &TlsVaultStorage{Mount: "secret", KVVersion: tt.version}
+		if got := fs.dataPath("tls/a.com.crt"); got != tt.data {
+			t.Errorf("v%d dataPath() = %s, want %s", tt.version, got, tt.data)
+		}
+		if got := fs.metadataPath("tls/a.com.crt"); got != tt.metadata {
+			t.Errorf("v%d metadataPath() = %s, want %s", tt.version, got, tt.metadata)
+		}
+	}
+}
+
+func TestTlsVaultStorage(t *testing.T) {
+	ctx := context.Background()
+	for _, version := range []int{1, 2} {
+		logical, secrets := testVaultKv(t, version)
+		fs := &TlsVaultStorage{Logical: logical, Mount: "secret", KVVersion: version}
+
+		// binary data survives the JSON round trip
+		crt, key := []byte("crt\x00\xff"), []byte("key")
+		for k, b := range map[string][]byte{"tls/a.com.crt": crt, "tls/a.com.key": key, "tls/b.com.crt": crt} {
+			if err := fs.Write(ctx, k, b); err != nil {
+				t.Fatalf("v%d Write(%s) = %v", version, k, err)
+			}
+		}
+		if _, ok := secrets["tls/a.com.crt"]["value"]; !ok {
+			t.Errorf("v%d secret = %v, want value field", version, secrets["tls/a.com.crt"])
+		}
+
+		b, err := fs.Read(ctx, "tls/a.com.crt")
+		if err != nil || string(b) != string(crt) {
+			t.Errorf("v%d Read() = %q, %v, want %q", version, b, err, crt)
+		}
+		if _, err = fs.Read(ctx, "tls/c.com.crt"); err == nil {
+			t.Errorf("v%d Read(missing) succeeded", version)
+		}
+		if ok, err := fs.Exists(ctx, "tls/c.com.crt"); ok || err != nil {
+			t.Errorf("v%d Exists(missing) = %v, %v", version, ok, err)
+		}
+
+		found, err := fs.Find(ctx, "tls", ".crt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"tls/a.com.crt", "tls/b.com.crt"}; !reflect.DeepEqual(found, want) {
+			t.Errorf("v%d Find() = %v, want %v", version, found, want)
+		}
+		if found, err = fs.Find(ctx, "other", ""); err != nil || len(found) != 0 {
+			t.Errorf("v%d Find(empty) = %v, %v", version, found, err)
+		}
+
+		if err = fs.Delete(ctx, "tls/a.com.crt"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := fs.Exists(ctx, "tls/a.com.crt"); ok || err != nil {
+			t.Errorf("v%d Exists(deleted) = %v, %v", version, ok, err)
+		}
+		keys := make([]string, 0, len(secrets))
+		for k := range secrets {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if want := []string{"tls/a.com.key", "tls/b.com.crt"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("v%d secrets after Delete = %v, want %v", version, keys, want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package cmds
 import (
 	"log"
 
+	"github.com/qbart/ohowl/cloudh"
 	"github.com/qbart/ohowl/tea"
 	"github.com/qbart/ohowl/web"
 	"github.com/spf13/cobra"
@@ -20,6 +21,11 @@ var cmdAgent = &cobra.Command{
 				Debug:             bootArgs.GetBoolDefault("debug", false),
 				AccountPathPrefix: bootArgs.GetString("account-path"),
 				CertPathPrefix:    bootArgs.GetString("cert-path"),
+				ChallengePathPrefix: bootArgs.GetStringDefault("challenge-path",
+					cloudh.TlsDefaultChallengePath(bootArgs.GetString("cert-path"))),
+				TlsAlpnListen: bootArgs.GetString("tls-alpn-listen"),
+				CaPathPrefix:  bootArgs.GetString("ca-path"),
+				CrlPath:       bootArgs.GetStringDefault("crl-path", "/crl.pem"),
 			}
 			app.Run()
 		} else {
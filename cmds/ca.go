@@ -0,0 +1,211 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/qbart/ohowl/cloudh"
+	"github.com/qbart/ohowl/tea"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCa = &cobra.Command{Use: "ca", Short: "Private CA for internal certificates"}
+
+	caInit = &cobra.Command{
+		Use:   "init",
+		Short: "Create root and intermediate CA",
+		Long:  `init name="Owl" ca-path=... cert-path=... cert-storage=... [key-type=ec384]`,
+		Run: caRun(func(ca *cloudh.TlsCa, vars *tea.EqArgs) error {
+			if err := ca.Init(vars.GetStringDefault("name", "Owl")); err != nil {
+				return err
+			}
+			root, err := ca.RootCertificate()
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(root))
+			return nil
+		}),
+	}
+
+	caIssue = &cobra.Command{
+		Use:   "issue",
+		Short: "Issue certificate signed by the intermediate CA",
+		Long:  `issue domains=*.node.consul ips=10.0.0.2 private-ip=true ca-path=... cert-path=... cert-storage=...`,
+		Run: caRun(func(ca *cloudh.TlsCa, vars *tea.EqArgs) error {
+			domains := make([]string, 0)
+			if vars.GetString("domains") != "" {
+				domains = vars.GetStrings("domains", ",")
+			}
+			ips, err := caIps(vars)
+			if err != nil {
+				return err
+			}
+			return ca.Issue(domains, ips)
+		}),
+	}
+
+	caRenew = &cobra.Command{
+		Use:   "renew",
+		Short: "Reissue certificates expiring within given number of days",
+		Long:  `renew [domains=...] days=30 ca-path=... cert-path=... cert-storage=...`,
+		Run: caRun(func(ca *cloudh.TlsCa, vars *tea.EqArgs) error {
+			var domains []string
+			if vars.GetString("domains") != "" {
+				domains = vars.GetStrings("domains", ",")
+			}
+			results, err := ca.Renew(domains, vars.GetIntDefault("days", 30))
+			if err != nil {
+				return err
+			}
+
+			failed := false
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Domains", "Status", "Error"})
+			for _, res := range results {
+				status, msg := "skipped", ""
+				if res.Err != nil {
+					status, msg = "failed", res.Err.Error()
+					failed = true
+				} else if res.Renewed {
+					status = "renewed"
+				}
+				table.Append([]string{res.Domain, status, msg})
+			}
+			table.Render()
+
+			if failed {
+				os.Exit(1)
+			}
+			return nil
+		}),
+	}
+
+	caList = &cobra.Command{
+		Use:   "list",
+		Short: "List certificates issued by the CA",
+		Run: caRun(func(ca *cloudh.TlsCa, vars *tea.EqArgs) error {
+			certs, err := ca.List()
+			if err != nil {
+				return err
+			}
+			return printTlsCerts(os.Stdout, certs, vars.GetStringDefault("format", "table"), false)
+		}),
+	}
+
+	caRevoke = &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke certificate (adds it to CRL) and remove it from storage",
+		Long:  `revoke domain=... [archive=true] ca-path=... cert-path=... cert-storage=...`,
+		Run: caRun(func(ca *cloudh.TlsCa, vars *tea.EqArgs) error {
+			vars.ValidatePresence("domain")
+			if !vars.Valid() {
+				return errors.New(vars.ErrorMessages())
+			}
+			return ca.Revoke(vars.GetString("domain"))
+		}),
+	}
+
+	caCrl = &cobra.Command{
+		Use:   "crl",
+		Short: "Sign fresh CRL and print it",
+		Run: caRun(func(ca *cloudh.TlsCa, vars *tea.EqArgs) error {
+			crl, err := ca.Crl()
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(crl))
+			return nil
+		}),
+	}
+
+	caRoot = &cobra.Command{
+		Use:   "root",
+		Short: "Print root CA certificate",
+		Run: caRun(func(ca *cloudh.TlsCa, vars *tea.EqArgs) error {
+			root, err := ca.RootCertificate()
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(root))
+			return nil
+		}),
+	}
+)
+
+func init() {
+	cmdCa.AddCommand(caInit)
+	cmdCa.AddCommand(caIssue)
+	cmdCa.AddCommand(caRenew)
+	cmdCa.AddCommand(caList)
+	cmdCa.AddCommand(caRevoke)
+	cmdCa.AddCommand(caCrl)
+	cmdCa.AddCommand(caRoot)
+}
+
+// caRun parses common CA args and runs fn with configured CA.
+func caRun(fn func(ca *cloudh.TlsCa, vars *tea.EqArgs) error) func(*cobra.Command, []string) {
+	return func(cmd *cobra.Command, args []string) {
+		vars := tea.ParseEqArgs(args)
+		vars.ValidatePresence("ca-path", "cert-path", "cert-storage")
+		vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
+		if _, ok := vars.Raw["format"]; ok {
+			vars.ValidateInclusion("format", []string{"table", "json", "yaml", "csv"})
+		}
+
+		if !vars.Valid() {
+			log.Fatal(vars.ErrorMessages())
+		}
+
+		validity, err := vars.GetDurationDefault("validity", 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ca := &cloudh.TlsCa{
+			Storage:        tlsStorage(vars, "cert"),
+			CaPathPrefix:   vars.GetString("ca-path"),
+			CertPathPrefix: vars.GetString("cert-path"),
+			KeyType:        tlsKeyType(vars, "key-type"),
+			Validity:       validity,
+			CrlURL:         vars.GetString("crl-url"),
+			ArchiveRevoked: vars.GetBoolDefault("archive", false),
+			Deploy:         tlsDeploy(vars),
+		}
+
+		if err := fn(ca, vars); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// caIps parses ips= arg and adds private IP of the server when private-ip=true.
+func caIps(vars *tea.EqArgs) ([]net.IP, error) {
+	ips := make([]net.IP, 0)
+	if vars.GetString("ips") != "" {
+		for _, s := range vars.GetStrings("ips", ",") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP: %s", s)
+			}
+			ips = append(ips, ip)
+		}
+	}
+
+	if vars.GetBoolDefault("private-ip", false) {
+		metadata, err := cloudh.GetMetadata()
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(metadata.PrivateIpv4)
+		if ip == nil {
+			return nil, fmt.Errorf("Server has no private IP")
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
@@ -1,14 +1,23 @@
 package cmds
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"path/filepath"
+	"os/user"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/olekukonko/tablewriter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/qbart/ohowl/cloudh"
 	"github.com/qbart/ohowl/tea"
 	"github.com/spf13/cobra"
@@ -79,12 +88,12 @@ var (
 			vars := tea.ParseEqArgs(args)
 			vars.ValidatePresence("cert-path", "cert-storage")
 			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
+			if _, ok := vars.Raw["format"]; ok {
+				vars.ValidateInclusion("format", []string{"table", "json", "yaml", "csv"})
+			}
 
 			if vars.Valid() {
-				cfs := cloudh.TlsStorageById(vars.GetString("cert-storage"))
-				if err := setupTlsFileStorage(cfs); err != nil {
-					log.Fatal(err)
-				}
+				cfs := tlsStorage(vars, "cert")
 
 				tls := cloudh.AutoTls{
 					Config: cloudh.TlsConfig{
@@ -95,63 +104,148 @@ var (
 					AccountStorage: &cloudh.TlsNullStorage{}, // not needed for listing
 				}
 
-				certs, err := tls.List()
+				check := vars.GetBoolDefault("check", false)
+				warning, err := vars.GetDurationDefault("warning", 30*24*time.Hour)
+				if err != nil {
+					log.Fatal(err)
+				}
+				critical, err := vars.GetDurationDefault("critical", 14*24*time.Hour)
+				if err != nil {
+					log.Fatal(err)
+				}
+				within, err := vars.GetDurationDefault("expiring-within", 0)
 				if err != nil {
 					log.Fatal(err)
 				}
 
-				table := tablewriter.NewWriter(os.Stdout)
-				table.SetHeader([]string{"Common Name", "DNS", "Expiry", "File"})
+				certs, err := tls.List()
+				if err != nil {
+					if check {
+						fmt.Printf("TLS %s - %v\n", checkStatusNames[checkUnknown], err)
+						os.Exit(checkUnknown)
+					}
+					log.Fatal(err)
+				}
+				certs = filterTlsExpiring(certs, within)
 
-				for _, cert := range certs {
-					table.Append([]string{
-						cert.CommonName,
-						strings.Join(cert.DNS, ", "),
-						cert.Expiry.String(),
-						filepath.Base(cert.Path),
-					})
+				if check {
+					if err := tls.CheckKeys(certs); err != nil {
+						fmt.Printf("TLS %s - %v\n", checkStatusNames[checkUnknown], err)
+						os.Exit(checkUnknown)
+					}
+					status, msg := checkTlsCerts(certs, warning, critical)
+					fmt.Println(msg)
+					os.Exit(status)
 				}
-				table.Render()
 
+				keys := vars.GetBoolDefault("keys", false)
+				if keys {
+					if err := tls.CheckKeys(certs); err != nil {
+						log.Fatal(err)
+					}
+				}
+				if err := printTlsCerts(os.Stdout, certs, vars.GetStringDefault("format", "table"), keys); err != nil {
+					log.Fatal(err)
+				}
 			} else {
 				log.Fatal(vars.ErrorMessages())
 			}
 		},
 	}
 
-	hcloudTlsIssue = &cobra.Command{
-		Use:   "issue",
-		Short: "Issue new certificate using DNS challenge",
+	hcloudTlsShow = &cobra.Command{
+		Use:   "show",
+		Short: "Show certificate details and metadata",
+		Long:  `show DOMAIN cert-path=... cert-storage=...`,
+		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			vars := tea.ParseEqArgs(args)
-			vars.ValidatePresence("token", "email", "domains", "cert-path", "account-path", "cert-storage", "account-storage")
+			domain := args[0]
+			vars := tea.ParseEqArgs(args[1:])
+			vars.ValidatePresence("cert-path", "cert-storage")
 			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
-			vars.ValidateInclusion("account-storage", []string{"fs", "consul", "vault"})
 
 			if vars.Valid() {
-				cfs := cloudh.TlsStorageById(vars.GetString("cert-storage"))
-				if err := setupTlsFileStorage(cfs); err != nil {
+				tls := cloudh.AutoTls{
+					Config: cloudh.TlsConfig{
+						CertPathPrefix: vars.GetString("cert-path"),
+					},
+					Storage:        tlsStorage(vars, "cert"),
+					AccountStorage: &cloudh.TlsNullStorage{},
+				}
+
+				cert, err := tls.Show(domain)
+				if err != nil {
 					log.Fatal(err)
 				}
-				afs := cloudh.TlsStorageById(vars.GetString("account-storage"))
-				if err := setupTlsFileStorage(afs); err != nil {
+				b, err := json.MarshalIndent(cert, "", "  ")
+				if err != nil {
 					log.Fatal(err)
 				}
+				fmt.Println(string(b))
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsIssue = &cobra.Command{
+		Use:   "issue",
+		Short: "Issue new certificate",
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			// domains are taken from CSR
+			if vars.GetString("csr") == "" {
+				vars.ValidatePresence("domains")
+			}
+			vars.ValidatePresence("cert-path", "cert-storage")
+			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
+			validateTlsIssuer(vars)
+			validateTlsDns(vars)
+
+			if vars.Valid() {
+				cfs := tlsStorage(vars, "cert")
+				afs := tlsStorage(vars, "account")
 
 				tls := cloudh.AutoTls{
-					Config: cloudh.TlsConfig{
-						DnsToken:          vars.GetString("token"),
-						Email:             vars.GetString("email"),
-						Domains:           vars.GetStrings("domains", ","),
-						CertPathPrefix:    vars.GetString("cert-path"),
-						AccountPathPrefix: vars.GetString("account-path"),
-						Debug:             vars.GetBoolDefault("debug", false),
-					},
+					Config:         tlsConfig(vars),
 					Storage:        cfs,
 					AccountStorage: afs,
+					Issuer:         tlsIssuer(vars),
 				}
 
-				err := tls.Issue()
+				var csr []byte
+				if path := vars.GetString("csr"); path != "" {
+					var err error
+					if csr, err = ioutil.ReadFile(path); err != nil {
+						log.Fatal(err)
+					}
+				}
+
+				if vars.GetBoolDefault("plan", false) {
+					var plan *cloudh.TlsPlan
+					var err error
+					if csr != nil {
+						plan, err = tls.PlanIssueCsr(csr)
+					} else {
+						plan, err = tls.PlanIssue()
+					}
+					if err != nil {
+						log.Fatal(err)
+					}
+					printTlsPlans(os.Stdout, []cloudh.TlsPlan{*plan})
+					return
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer tea.SysCallNotifyDefault(func(os.Signal) { cancel() })()
+				tls.Context = ctx
+
+				var err error
+				if csr != nil {
+					err = tls.IssueCsr(csr)
+				} else {
+					err = tls.Issue()
+				}
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -166,34 +260,300 @@ var (
 		Short: "Attempts certifcate renowal",
 		Run: func(cmd *cobra.Command, args []string) {
 			vars := tea.ParseEqArgs(args)
-			vars.ValidatePresence("token", "email", "domains", "cert-path", "account-path", "cert-storage", "account-storage")
+			vars.ValidatePresence("domains", "cert-path", "cert-storage")
 			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
-			vars.ValidateInclusion("account-storage", []string{"fs", "consul", "vault"})
+			validateTlsIssuer(vars)
+			validateTlsDns(vars)
+			if _, ok := vars.Raw["domains-changed"]; ok {
+				vars.ValidateInclusion("domains-changed", []string{"fail", "merge", "replace"})
+			}
+			if _, ok := vars.Raw["days"]; ok {
+				vars.ValidateInt("days", 0)
+			}
 
 			if vars.Valid() {
-				cfs := cloudh.TlsStorageById(vars.GetString("cert-storage"))
-				if err := setupTlsFileStorage(cfs); err != nil {
+				cfs := tlsStorage(vars, "cert")
+				afs := tlsStorage(vars, "account")
+
+				tls := cloudh.AutoTls{
+					Config:         tlsConfig(vars),
+					Storage:        cfs,
+					AccountStorage: afs,
+					Issuer:         tlsIssuer(vars),
+				}
+
+				if vars.GetBoolDefault("plan", false) {
+					plan, err := tls.PlanRenew(false)
+					if err != nil {
+						log.Fatal(err)
+					}
+					printTlsPlans(os.Stdout, []cloudh.TlsPlan{*plan})
+					return
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer tea.SysCallNotifyDefault(func(os.Signal) { cancel() })()
+				tls.Context = ctx
+
+				err := tls.Renew(false)
+				if err != nil {
 					log.Fatal(err)
 				}
-				afs := cloudh.TlsStorageById(vars.GetString("account-storage"))
-				if err := setupTlsFileStorage(afs); err != nil {
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsRenewAll = &cobra.Command{
+		Use:   "renew-all",
+		Short: "Attempts renewal of every stored certificate",
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			vars.ValidatePresence("cert-path", "cert-storage")
+			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
+			validateTlsIssuer(vars)
+			validateTlsDns(vars)
+			if _, ok := vars.Raw["days"]; ok {
+				vars.ValidateInt("days", 0)
+			}
+
+			if vars.Valid() {
+				cfs := tlsStorage(vars, "cert")
+				afs := tlsStorage(vars, "account")
+
+				tls := cloudh.AutoTls{
+					Config:         tlsConfig(vars),
+					Storage:        cfs,
+					AccountStorage: afs,
+					Issuer:         tlsIssuer(vars),
+				}
+
+				if vars.GetBoolDefault("plan", false) {
+					plans, err := tls.PlanRenewAll()
+					if err != nil {
+						log.Fatal(err)
+					}
+					if printTlsPlans(os.Stdout, plans) {
+						os.Exit(1)
+					}
+					return
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer tea.SysCallNotifyDefault(func(os.Signal) { cancel() })()
+				tls.Context = ctx
+
+				results, err := tls.RenewAll(vars.GetIntDefault("parallel", 4))
+				if err != nil {
 					log.Fatal(err)
 				}
 
+				failed := false
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetHeader([]string{"Domains", "Status", "Error"})
+
+				for _, res := range results {
+					status, msg := "skipped", ""
+					var deployErr *cloudh.TlsDeployError
+					switch {
+					case errors.As(res.Err, &deployErr) && res.Renewed:
+						status, msg = "renewed, deploy failed", deployErr.Err.Error()
+						failed = true
+					case errors.As(res.Err, &deployErr):
+						status, msg = "deploy failed", deployErr.Err.Error()
+						failed = true
+					case res.Err != nil:
+						status, msg = "failed", res.Err.Error()
+						failed = true
+					case res.Renewed:
+						status = "renewed"
+					}
+					table.Append([]string{res.Domain, status, msg})
+				}
+				table.Render()
+
+				if failed {
+					os.Exit(1)
+				}
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsDeploy = &cobra.Command{
+		Use:   "deploy",
+		Short: "Writes stored certificate to deploy targets",
+		Long:  `deploy DOMAIN deploy=targets.yml cert-path=... cert-storage=...`,
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			domain := args[0]
+			vars := tea.ParseEqArgs(args[1:])
+			vars.ValidatePresence("deploy", "cert-path", "cert-storage")
+			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
+
+			if vars.Valid() {
 				tls := cloudh.AutoTls{
 					Config: cloudh.TlsConfig{
-						DnsToken:          vars.GetString("token"),
-						Email:             vars.GetString("email"),
-						Domains:           vars.GetStrings("domains", ","),
-						CertPathPrefix:    vars.GetString("cert-path"),
-						AccountPathPrefix: vars.GetString("account-path"),
-						Debug:             vars.GetBoolDefault("debug", false),
+						CertPathPrefix: vars.GetString("cert-path"),
+						Deploy:         tlsDeploy(vars),
 					},
+					Storage:        tlsStorage(vars, "cert"),
+					AccountStorage: &cloudh.TlsNullStorage{},
+				}
+
+				if err := tls.Deploy(domain); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsPreflight = &cobra.Command{
+		Use:   "preflight",
+		Short: "Checks domains (IDNA, CAA, DNS zone access) without ordering",
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			vars.ValidatePresence("domains")
+			validateTlsDns(vars)
+
+			if vars.Valid() {
+				tls := cloudh.AutoTls{
+					Config:         tlsConfig(vars),
+					Storage:        &cloudh.TlsNullStorage{},
+					AccountStorage: &cloudh.TlsNullStorage{},
+					Issuer:         tlsIssuer(vars),
+				}
+
+				results, err := tls.Preflight(tls.Config.Domains)
+
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetHeader([]string{"Domain", "Check", "Status", "Message"})
+				for _, res := range results {
+					table.Append([]string{res.Domain, res.Check, res.Status, res.Message})
+				}
+				table.Render()
+
+				if err != nil {
+					os.Exit(1)
+				}
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsSync = &cobra.Command{
+		Use:   "sync",
+		Short: "Mirrors certificates from storage into local directory",
+		Long:  `sync dir=/etc/ssl/owl cert-path=... cert-storage=... [domains=...] [hook=...] [watch=true]`,
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			vars.ValidatePresence("dir", "cert-path", "cert-storage")
+			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
+
+			if vars.Valid() {
+				local := &cloudh.TlsFileStorage{}
+				if err := setupTlsFileStorage(local, vars, "local"); err != nil {
+					log.Fatal(err)
+				}
+
+				sync := cloudh.TlsSync{
+					Tls: &cloudh.AutoTls{
+						Config: cloudh.TlsConfig{
+							CertPathPrefix: vars.GetString("cert-path"),
+						},
+						Storage:        tlsStorage(vars, "cert"),
+						AccountStorage: &cloudh.TlsNullStorage{},
+					},
+					Local:    local,
+					Dir:      vars.GetString("dir"),
+					Hook:     vars.GetString("hook"),
+					Interval: time.Duration(vars.GetIntDefault("interval", 60)) * time.Second,
+				}
+				if vars.GetString("domains") != "" {
+					sync.Domains = vars.GetStrings("domains", ",")
+				}
+
+				if !vars.GetBoolDefault("watch", false) {
+					if _, err := sync.Sync(context.TODO()); err != nil {
+						log.Fatal(err)
+					}
+					return
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer tea.SysCallNotifyDefault(func(os.Signal) { cancel() })()
+				if err := sync.Watch(ctx); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsExporter = &cobra.Command{
+		Use:   "exporter",
+		Short: "Serves Prometheus metrics of stored certificates",
+		Long:  `exporter listen=:9914 cert-path=... cert-storage=...`,
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			vars.ValidatePresence("cert-path", "cert-storage")
+			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
+
+			if vars.Valid() {
+				prometheus.MustRegister(&cloudh.TlsCertCollector{
+					Tls: &cloudh.AutoTls{
+						Config: cloudh.TlsConfig{
+							CertPathPrefix: vars.GetString("cert-path"),
+						},
+						Storage:        tlsStorage(vars, "cert"),
+						AccountStorage: &cloudh.TlsNullStorage{},
+					},
+					Storage: vars.GetString("cert-storage"),
+				})
+
+				listen := vars.GetStringDefault("listen", ":9914")
+				http.Handle("/metrics", promhttp.Handler())
+				log.Printf("Serving metrics on %s/metrics", listen)
+				log.Fatal(http.ListenAndServe(listen, nil))
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsRevoke = &cobra.Command{
+		Use:   "revoke",
+		Short: "Revokes certificate and removes it from storage",
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			vars.ValidatePresence("email", "domain", "cert-path", "account-path", "cert-storage", "account-storage")
+			vars.ValidateInclusion("cert-storage", []string{"fs", "consul", "vault"})
+			vars.ValidateInclusion("account-storage", []string{"fs", "consul", "vault"})
+
+			if vars.Valid() {
+				reason, ok := cloudh.TlsRevocationReasons[vars.GetStringDefault("reason", "unspecified")]
+				if !ok {
+					log.Fatal("reason must be one of: unspecified, keyCompromise, affiliationChanged, superseded, cessationOfOperation")
+				}
+
+				cfs := tlsStorage(vars, "cert")
+				afs := tlsStorage(vars, "account")
+
+				config := tlsConfig(vars)
+				config.ArchiveRevoked = vars.GetBoolDefault("archive", false)
+				tls := cloudh.AutoTls{
+					Config:         config,
 					Storage:        cfs,
 					AccountStorage: afs,
 				}
 
-				err := tls.Renew(false)
+				err := tls.Revoke(vars.GetString("domain"), reason)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -210,27 +570,347 @@ func init() {
 	cmdHCloud.AddCommand(hcloudServers)
 	cmdHCloud.AddCommand(cmdHCloudTls)
 	cmdHCloudTls.AddCommand(hcloudTlsList)
+	cmdHCloudTls.AddCommand(hcloudTlsShow)
 	cmdHCloudTls.AddCommand(hcloudTlsIssue)
 	cmdHCloudTls.AddCommand(hcloudTlsRenew)
+	cmdHCloudTls.AddCommand(hcloudTlsRenewAll)
+	cmdHCloudTls.AddCommand(hcloudTlsDeploy)
+	cmdHCloudTls.AddCommand(hcloudTlsPreflight)
+	cmdHCloudTls.AddCommand(hcloudTlsSync)
+	cmdHCloudTls.AddCommand(hcloudTlsExporter)
+	cmdHCloudTls.AddCommand(hcloudTlsRevoke)
+}
+
+// tlsConfig builds TlsConfig of ordering commands from args,
+// DNS provider credentials given as dns.<ENV>= are exported to environment.
+func tlsConfig(vars *tea.EqArgs) cloudh.TlsConfig {
+	for k, v := range vars.Raw {
+		if strings.HasPrefix(k, "dns.") {
+			os.Setenv(strings.TrimPrefix(k, "dns."), v)
+		}
+	}
+
+	config := cloudh.TlsConfig{
+		DnsToken:            vars.GetString("token"),
+		DnsProvider:         vars.GetString("dns-provider"),
+		DnsProviders:        tlsDnsProviders(vars),
+		Dns:                 tlsDnsOptions(vars),
+		Challenge:           tlsChallenge(vars),
+		ChallengePathPrefix: vars.GetString("challenge-path"),
+		Email:               vars.GetString("email"),
+		CertPathPrefix:      vars.GetString("cert-path"),
+		AccountPathPrefix:   vars.GetString("account-path"),
+		Debug:               vars.GetBoolDefault("debug", false),
+		AcmeDirectory:       vars.GetString("acme-directory"),
+		EabKid:              vars.GetString("eab-kid"),
+		EabHmac:             vars.GetString("eab-hmac"),
+		CaBundle:            vars.GetString("ca-bundle"),
+		KeyType:             tlsKeyType(vars, "key-type"),
+		AccountKeyType:      tlsKeyType(vars, "account-key-type"),
+		RenewDays:           tlsRenewDays(vars),
+		DomainsChanged:      vars.GetStringDefault("domains-changed", cloudh.TlsDomainsFail),
+		LockWait:            vars.GetStringDefault("lock", "skip") == "wait",
+		SkipPreflight:       !vars.GetBoolDefault("preflight", true),
+		PreflightProbe:      vars.GetBoolDefault("preflight-probe", false),
+		Deploy:              tlsDeploy(vars),
+	}
+	if vars.GetString("domains") != "" {
+		config.Domains = vars.GetStrings("domains", ",")
+	}
+	return config
+}
+
+// tlsDnsProviders parses dns-map=<domain>:<provider>,... (see validateTlsDns).
+func tlsDnsProviders(vars *tea.EqArgs) map[string]string {
+	providers := make(map[string]string)
+	if vars.GetString("dns-map") == "" {
+		return providers
+	}
+	for _, entry := range vars.GetStrings("dns-map", ",") {
+		kv := strings.SplitN(entry, ":", 2)
+		providers[kv[0]] = kv[1]
+	}
+	return providers
+}
+
+// validateTlsDns validates dns-map= and requires a DNS provider
+// when certificates are ordered from ACME using dns-01.
+func validateTlsDns(vars *tea.EqArgs) {
+	if vars.GetString("dns-map") != "" {
+		vars.ValidatePairs("dns-map", ",", ":")
+	}
+	if vars.GetStringDefault("issuer", cloudh.TlsIssuerAcme) == cloudh.TlsIssuerAcme &&
+		vars.GetStringDefault("challenge", cloudh.TlsChallengeDns01) == cloudh.TlsChallengeDns01 {
+		vars.ValidateAnyPresence("token", "dns-provider", "dns-map")
+	}
+}
+
+// tlsDnsOptions parses DNS-01 propagation args.
+func tlsDnsOptions(vars *tea.EqArgs) cloudh.TlsDnsOptions {
+	opts := cloudh.TlsDnsOptions{
+		TTL:         vars.GetIntDefault("dns-ttl", 0),
+		SkipNsCheck: vars.GetBoolDefault("dns-skip-ns-check", false),
+	}
+	if vars.GetString("dns-resolvers") != "" {
+		opts.Resolvers = vars.GetStrings("dns-resolvers", ",")
+	}
+
+	var err error
+	for key, d := range map[string]*time.Duration{
+		"dns-timeout":  &opts.PropagationTimeout,
+		"dns-interval": &opts.PollingInterval,
+		"dns-delay":    &opts.Delay,
+	} {
+		if *d, err = vars.GetDurationDefault(key, 0); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return opts
+}
+
+// validateTlsIssuer validates issuer= arg and args required by the selected issuer.
+func validateTlsIssuer(vars *tea.EqArgs) {
+	if _, ok := vars.Raw["issuer"]; ok {
+		vars.ValidateInclusion("issuer", []string{cloudh.TlsIssuerAcme, cloudh.TlsIssuerVaultPki})
+	}
+	switch vars.GetStringDefault("issuer", cloudh.TlsIssuerAcme) {
+	case cloudh.TlsIssuerAcme:
+		vars.ValidatePresence("email", "account-path", "account-storage")
+		vars.ValidateInclusion("account-storage", []string{"fs", "consul", "vault"})
+		validateTlsEab(vars)
+	case cloudh.TlsIssuerVaultPki:
+		vars.ValidatePresence("vault-pki-role")
+	}
 }
 
-func setupTlsFileStorage(storage cloudh.TlsStorage) error {
+// validateTlsEab requires eab-kid and eab-hmac to be given together.
+func validateTlsEab(vars *tea.EqArgs) {
+	if _, ok := vars.Raw["eab-kid"]; ok {
+		vars.ValidatePresence("eab-hmac")
+	}
+	if _, ok := vars.Raw["eab-hmac"]; ok {
+		vars.ValidatePresence("eab-kid")
+	}
+}
+
+// tlsIssuer returns issuer selected by issuer= arg, nil for ACME (default).
+func tlsIssuer(vars *tea.EqArgs) cloudh.TlsIssuer {
+	if vars.GetStringDefault("issuer", cloudh.TlsIssuerAcme) != cloudh.TlsIssuerVaultPki {
+		return nil
+	}
+	vault, err := tea.NewVault()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &cloudh.TlsVaultPkiIssuer{
+		Logical: vault.Logical(),
+		Mount:   vars.GetStringDefault("vault-pki-mount", "pki"),
+		Role:    vars.GetString("vault-pki-role"),
+		TTL:     vars.GetString("vault-pki-ttl"),
+	}
+}
+
+// tlsRenewDays returns days= arg, nil when not given (cloudh default applies).
+func tlsRenewDays(vars *tea.EqArgs) *int {
+	if _, ok := vars.Raw["days"]; !ok {
+		return nil
+	}
+	days := vars.GetIntDefault("days", 0)
+	return &days
+}
+
+// tlsChallenge returns challenge= arg (dns-01 by default).
+func tlsChallenge(vars *tea.EqArgs) string {
+	challenge := vars.GetStringDefault("challenge", cloudh.TlsChallengeDns01)
+	switch challenge {
+	case cloudh.TlsChallengeDns01, cloudh.TlsChallengeHttp01, cloudh.TlsChallengeTlsAlpn01:
+		return challenge
+	}
+	log.Fatal("challenge must be one of: dns-01, http-01, tls-alpn-01")
+	return ""
+}
+
+// tlsDeploy loads deploy targets from deploy=<file> arg, nil when not given.
+func tlsDeploy(vars *tea.EqArgs) map[string][]cloudh.TlsDeployTarget {
+	path := vars.GetString("deploy")
+	if path == "" {
+		return nil
+	}
+	targets, err := cloudh.LoadTlsDeployTargets(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return targets
+}
+
+// tlsKeyType parses key type arg, empty when not given.
+func tlsKeyType(vars *tea.EqArgs, key string) certcrypto.KeyType {
+	name := vars.GetString(key)
+	if name == "" {
+		return ""
+	}
+	keyType, ok := cloudh.TlsKeyTypes[name]
+	if !ok {
+		log.Fatalf("%s must be one of: rsa2048, rsa4096, rsa8192, ec256, ec384", key)
+	}
+	return keyType
+}
+
+// tlsStorage builds storage selected by <kind>-storage arg,
+// wrapped with encryption when <kind>-encryption arg is given.
+func tlsStorage(vars *tea.EqArgs, kind string) cloudh.TlsStorage {
+	return newTlsStorage(vars.GetString(kind+"-storage"), vars, kind)
+}
+
+// tlsStorageSpec parses <storage>:<path> spec (e.g. fs:/etc/owl, consul:tls)
+// into storage configured by <kind>-* args and path.
+func tlsStorageSpec(vars *tea.EqArgs, kind string) (cloudh.TlsStorage, string) {
+	kv := strings.SplitN(vars.GetString(kind), ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		log.Fatalf("%s must be in <storage>:<path> format", kind)
+	}
+	if kv[0] != "fs" && kv[0] != "consul" && kv[0] != "vault" {
+		log.Fatalf("%s storage must be one of: fs, consul, vault", kind)
+	}
+	return newTlsStorage(kv[0], vars, kind), kv[1]
+}
+
+func newTlsStorage(id string, vars *tea.EqArgs, kind string) cloudh.TlsStorage {
+	storage := cloudh.TlsStorageById(id)
+	if err := setupTlsFileStorage(storage, vars, kind); err != nil {
+		log.Fatal(err)
+	}
+
+	spec := vars.GetString(kind + "-encryption")
+	if spec == "" {
+		return storage
+	}
+	wrapper, err := tlsKeyWrapper(spec, vars)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &cloudh.TlsEncryptedStorage{
+		Storage: storage,
+		Wrapper: wrapper,
+		Strict:  vars.GetBoolDefault(kind+"-encryption-strict", false),
+	}
+}
+
+// tlsKeyWrapper parses keyfile:<path> or transit:<key-name> spec.
+func tlsKeyWrapper(spec string, vars *tea.EqArgs) (cloudh.TlsKeyWrapper, error) {
+	kv := strings.SplitN(spec, ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return nil, fmt.Errorf("Invalid encryption %s, expected keyfile:<path> or transit:<key-name>", spec)
+	}
+
+	switch kv[0] {
+	case "keyfile":
+		return cloudh.NewTlsFileKeyWrapper(kv[1])
+
+	case "transit":
+		vault, err := tea.NewVault()
+		if err != nil {
+			return nil, err
+		}
+		return &cloudh.TlsTransitKeyWrapper{
+			Logical: vault.Logical(),
+			Mount:   vars.GetStringDefault("vault-transit-mount", "transit"),
+			KeyName: kv[1],
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid encryption %s, expected keyfile:<path> or transit:<key-name>", spec)
+}
+
+// tlsFilePerm reads <prefix>-mode (octal), <prefix>-owner and <prefix>-group
+// (names or numeric ids).
+func tlsFilePerm(vars *tea.EqArgs, prefix string) (cloudh.TlsFilePerm, bool, error) {
+	perm := cloudh.TlsFilePerm{Uid: -1, Gid: -1}
+	found := false
+
+	if v := vars.GetString(prefix + "-mode"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return perm, false, fmt.Errorf("%s-mode must be octal (e.g. 0640)", prefix)
+		}
+		perm.Mode = os.FileMode(mode)
+		found = true
+	}
+	if v := vars.GetString(prefix + "-owner"); v != "" {
+		uid, err := strconv.Atoi(v)
+		if err != nil {
+			u, lookupErr := user.Lookup(v)
+			if lookupErr != nil {
+				return perm, false, lookupErr
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		perm.Uid = uid
+		found = true
+	}
+	if v := vars.GetString(prefix + "-group"); v != "" {
+		gid, err := strconv.Atoi(v)
+		if err != nil {
+			g, lookupErr := user.LookupGroup(v)
+			if lookupErr != nil {
+				return perm, false, lookupErr
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		perm.Gid = gid
+		found = true
+	}
+
+	return perm, found, nil
+}
+
+func setupTlsFileStorage(storage cloudh.TlsStorage, vars *tea.EqArgs, kind string) error {
 	switch storage.(type) {
 	case *cloudh.TlsFileStorage:
-		// FS is fine by default
+		fileStorage := storage.(*cloudh.TlsFileStorage)
+		fileStorage.Perms = make(map[string]cloudh.TlsFilePerm)
+
+		// <kind>-mode= <kind>-owner= <kind>-group= for all files
+		// <kind>-key-mode= ... for .key files only, etc.
+		for _, ext := range []string{"", "key", "crt", "ca"} {
+			prefix := kind
+			if ext != "" {
+				prefix = fmt.Sprint(kind, "-", ext)
+				ext = "." + ext
+			}
+			perm, ok, err := tlsFilePerm(vars, prefix)
+			if err != nil {
+				return err
+			}
+			if ok {
+				fileStorage.Perms[ext] = perm
+			}
+		}
 		return nil
 
 	case *cloudh.TlsConsulStorage:
 		if consul, err := tea.NewConsul(); err == nil {
 			consulStorage := storage.(*cloudh.TlsConsulStorage)
 			consulStorage.KV = consul.KV()
+			consulStorage.Session = consul.Session()
 			return nil
 		} else {
 			return err
 		}
 
 	case *cloudh.TlsVaultStorage:
-		return errors.New("Vault storage not implemented")
+		if vault, err := tea.NewVault(); err == nil {
+			vaultStorage := storage.(*cloudh.TlsVaultStorage)
+			vaultStorage.Logical = vault.Logical()
+			vaultStorage.Mount = vars.GetStringDefault("vault-mount", "secret")
+			vaultStorage.KVVersion = vars.GetIntDefault("vault-kv-version", 2)
+			if vaultStorage.KVVersion != 1 && vaultStorage.KVVersion != 2 {
+				return errors.New("vault-kv-version must be one of: 1, 2")
+			}
+			return nil
+		} else {
+			return err
+		}
 	}
 
 	return errors.New("Invalid storage setup")
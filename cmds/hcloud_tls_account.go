@@ -0,0 +1,125 @@
+package cmds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/qbart/ohowl/cloudh"
+	"github.com/qbart/ohowl/tea"
+	"github.com/spf13/cobra"
+)
+
+var (
+	hcloudTlsAccount = &cobra.Command{Use: "account", Short: "ACME account"}
+
+	hcloudTlsAccountShow = &cobra.Command{
+		Use:   "show",
+		Short: "Show account registration",
+		Run: tlsAccountRun(func(tls *cloudh.AutoTls, vars *tea.EqArgs) error {
+			return printTlsAccount(tls.ShowAccount())
+		}),
+	}
+
+	hcloudTlsAccountRegister = &cobra.Command{
+		Use:   "register",
+		Short: "Register account (creates account key when missing)",
+		Run: tlsAccountRun(func(tls *cloudh.AutoTls, vars *tea.EqArgs) error {
+			return printTlsAccount(tls.RegisterAccount())
+		}),
+	}
+
+	hcloudTlsAccountUpdateEmail = &cobra.Command{
+		Use:   "update-email",
+		Short: "Change account contact email",
+		Long:  `update-email email=old@example.com new-email=new@example.com ...`,
+		Run: tlsAccountRun(func(tls *cloudh.AutoTls, vars *tea.EqArgs) error {
+			vars.ValidatePresence("new-email")
+			if !vars.Valid() {
+				return errors.New(vars.ErrorMessages())
+			}
+			if err := tls.UpdateAccountEmail(vars.GetString("new-email")); err != nil {
+				return err
+			}
+			return printTlsAccount(tls.ShowAccount())
+		}),
+	}
+
+	hcloudTlsAccountRotateKey = &cobra.Command{
+		Use:   "rotate-key",
+		Short: "Replace account key (key rollover)",
+		Run: tlsAccountRun(func(tls *cloudh.AutoTls, vars *tea.EqArgs) error {
+			if err := tls.RotateAccountKey(); err != nil {
+				return err
+			}
+			return printTlsAccount(tls.ShowAccount())
+		}),
+	}
+
+	hcloudTlsAccountDeactivate = &cobra.Command{
+		Use:   "deactivate",
+		Short: "Deactivate account (irreversible)",
+		Long:  `deactivate confirm=true ...`,
+		Run: tlsAccountRun(func(tls *cloudh.AutoTls, vars *tea.EqArgs) error {
+			if !vars.GetBoolDefault("confirm", false) {
+				return fmt.Errorf("Deactivation can't be undone, pass confirm=true")
+			}
+			return tls.DeactivateAccount()
+		}),
+	}
+)
+
+func init() {
+	cmdHCloudTls.AddCommand(hcloudTlsAccount)
+	hcloudTlsAccount.AddCommand(hcloudTlsAccountShow)
+	hcloudTlsAccount.AddCommand(hcloudTlsAccountRegister)
+	hcloudTlsAccount.AddCommand(hcloudTlsAccountUpdateEmail)
+	hcloudTlsAccount.AddCommand(hcloudTlsAccountRotateKey)
+	hcloudTlsAccount.AddCommand(hcloudTlsAccountDeactivate)
+}
+
+// tlsAccountRun parses common account args and runs fn with configured AutoTls.
+func tlsAccountRun(fn func(tls *cloudh.AutoTls, vars *tea.EqArgs) error) func(*cobra.Command, []string) {
+	return func(cmd *cobra.Command, args []string) {
+		vars := tea.ParseEqArgs(args)
+		vars.ValidatePresence("email", "account-path", "account-storage")
+		vars.ValidateInclusion("account-storage", []string{"fs", "consul", "vault"})
+		validateTlsEab(vars)
+
+		if !vars.Valid() {
+			log.Fatal(vars.ErrorMessages())
+		}
+
+		tls := &cloudh.AutoTls{
+			Config: cloudh.TlsConfig{
+				Email:             vars.GetString("email"),
+				AccountPathPrefix: vars.GetString("account-path"),
+				Debug:             vars.GetBoolDefault("debug", false),
+				AcmeDirectory:     vars.GetString("acme-directory"),
+				EabKid:            vars.GetString("eab-kid"),
+				EabHmac:           vars.GetString("eab-hmac"),
+				CaBundle:          vars.GetString("ca-bundle"),
+				AccountKeyType:    tlsKeyType(vars, "account-key-type"),
+			},
+			Storage:        &cloudh.TlsNullStorage{},
+			AccountStorage: tlsStorage(vars, "account"),
+		}
+
+		if err := fn(tls, vars); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func printTlsAccount(acc *cloudh.TlsAccount, err error) error {
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(acc, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,162 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/qbart/ohowl/cloudh"
+	"github.com/qbart/ohowl/tea"
+	"github.com/spf13/cobra"
+)
+
+var (
+	hcloudTlsMigrate = &cobra.Command{
+		Use:   "migrate",
+		Short: "Copies certificates/accounts between storages",
+		Long:  `migrate from=fs:/etc/owl to=consul:tls [dry-run=true]`,
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			vars.ValidatePresence("from", "to")
+
+			if vars.Valid() {
+				from, fromPath := tlsStorageSpec(vars, "from")
+				to, toPath := tlsStorageSpec(vars, "to")
+				dryRun := vars.GetBoolDefault("dry-run", false)
+
+				res, err := cloudh.TlsMigrate(context.TODO(), from, fromPath, to, toPath, dryRun)
+				printTlsMigrations(res, dryRun)
+				if err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsExport = &cobra.Command{
+		Use:   "export",
+		Short: "Packs certificates/accounts into tar.gz archive",
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			vars.ValidatePresence("file")
+
+			if vars.Valid() {
+				sources := tlsArchiveSources(vars)
+
+				var buf bytes.Buffer
+				res, err := cloudh.TlsExport(context.TODO(), &buf, sources)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				b := buf.Bytes()
+				if spec := vars.GetString("encryption"); spec != "" {
+					wrapper, err := tlsKeyWrapper(spec, vars)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if b, err = cloudh.TlsSeal(context.TODO(), wrapper, b, nil); err != nil {
+						log.Fatal(err)
+					}
+				}
+
+				if err = ioutil.WriteFile(vars.GetString("file"), b, 0o600); err != nil {
+					log.Fatal(err)
+				}
+				printTlsMigrations(res, false)
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+
+	hcloudTlsImport = &cobra.Command{
+		Use:   "import",
+		Short: "Restores certificates/accounts from tar.gz archive",
+		Run: func(cmd *cobra.Command, args []string) {
+			vars := tea.ParseEqArgs(args)
+			vars.ValidatePresence("file")
+
+			if vars.Valid() {
+				sources := tlsArchiveSources(vars)
+
+				b, err := ioutil.ReadFile(vars.GetString("file"))
+				if err != nil {
+					log.Fatal(err)
+				}
+				if cloudh.TlsSealed(b) {
+					spec := vars.GetString("encryption")
+					if spec == "" {
+						log.Fatal("Archive is encrypted, encryption= is missing")
+					}
+					wrapper, err := tlsKeyWrapper(spec, vars)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if b, err = cloudh.TlsOpen(context.TODO(), wrapper, b, nil); err != nil {
+						log.Fatal(err)
+					}
+				}
+
+				dryRun := vars.GetBoolDefault("dry-run", false)
+				res, err := cloudh.TlsImport(context.TODO(), bytes.NewReader(b), sources, dryRun)
+				printTlsMigrations(res, dryRun)
+				if err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				log.Fatal(vars.ErrorMessages())
+			}
+		},
+	}
+)
+
+func init() {
+	cmdHCloudTls.AddCommand(hcloudTlsMigrate)
+	cmdHCloudTls.AddCommand(hcloudTlsExport)
+	cmdHCloudTls.AddCommand(hcloudTlsImport)
+}
+
+// tlsArchiveSources builds cert/account sources from cert-path/cert-storage
+// and account-path/account-storage args (at least one is required).
+func tlsArchiveSources(vars *tea.EqArgs) []cloudh.TlsArchiveSource {
+	sources := make([]cloudh.TlsArchiveSource, 0, 2)
+	for _, kind := range []string{"cert", "account"} {
+		if vars.GetString(kind+"-path") == "" {
+			continue
+		}
+		switch vars.GetString(kind + "-storage") {
+		case "fs", "consul", "vault":
+		default:
+			log.Fatalf("%s-storage must be one of: fs, consul, vault", kind)
+		}
+
+		sources = append(sources, cloudh.TlsArchiveSource{
+			Name:    kind,
+			Storage: tlsStorage(vars, kind),
+			Prefix:  vars.GetString(kind + "-path"),
+		})
+	}
+	if len(sources) == 0 {
+		log.Fatal("cert-path or account-path is missing")
+	}
+	return sources
+}
+
+func printTlsMigrations(res []cloudh.TlsMigration, dryRun bool) {
+	if dryRun {
+		fmt.Println("Dry run, nothing was written")
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"From", "To", "Size", "SHA256"})
+	for _, m := range res {
+		table.Append([]string{m.From, m.To, fmt.Sprint(m.Size), m.Checksum[:16]})
+	}
+	table.Render()
+}
@@ -0,0 +1,175 @@
+package cmds
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/qbart/ohowl/cloudh"
+	"gopkg.in/yaml.v2"
+)
+
+// Nagios/Icinga plugin exit codes.
+const (
+	checkOk       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStatusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// filterTlsExpiring returns certificates expiring within d (all when d is 0).
+func filterTlsExpiring(certs []cloudh.TlsCert, d time.Duration) []cloudh.TlsCert {
+	if d == 0 {
+		return certs
+	}
+	deadline := time.Now().Add(d)
+	res := make([]cloudh.TlsCert, 0)
+	for _, cert := range certs {
+		if cert.Expiry.Before(deadline) {
+			res = append(res, cert)
+		}
+	}
+	return res
+}
+
+// printTlsCerts writes certificates in format, table and csv get
+// Key Match column when keys were checked (see AutoTls.CheckKeys).
+func printTlsCerts(w io.Writer, certs []cloudh.TlsCert, format string, keys bool) error {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(certs, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+
+	case "yaml":
+		// round trip through JSON so yaml keys follow json tags
+		b, err := json.Marshal(certs)
+		if err != nil {
+			return err
+		}
+		var doc []yaml.MapSlice
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return err
+		}
+		b, err = yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		header := []string{"common_name", "dns", "expiry", "days_left", "key_type", "issuer", "serial", "file"}
+		if keys {
+			header = append(header, "key_match")
+		}
+		cw.Write(header)
+		for _, cert := range certs {
+			row := []string{
+				cert.CommonName,
+				strings.Join(cert.DNS, " "),
+				cert.Expiry.UTC().Format(time.RFC3339),
+				strconv.Itoa(cert.DaysLeft),
+				cert.KeyType,
+				cert.Issuer,
+				cert.Serial,
+				filepath.Base(cert.Path),
+			}
+			if keys {
+				row = append(row, tlsKeyMatch(cert))
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	table := tablewriter.NewWriter(w)
+	header := []string{"Common Name", "DNS", "Expiry", "Days Left", "Key Type", "Issuer", "Serial", "File"}
+	if keys {
+		header = append(header, "Key Match")
+	}
+	table.SetHeader(header)
+	for _, cert := range certs {
+		row := []string{
+			cert.CommonName,
+			strings.Join(cert.DNS, ", "),
+			cert.Expiry.UTC().Format("2006-01-02 15:04 MST"),
+			strconv.Itoa(cert.DaysLeft),
+			cert.KeyType,
+			cert.Issuer,
+			cert.Serial,
+			filepath.Base(cert.Path),
+		}
+		if keys {
+			row = append(row, tlsKeyMatch(cert))
+		}
+		table.Append(row)
+	}
+	table.Render()
+	return nil
+}
+
+// tlsKeyMatch describes KeyMatch of cert, certificates issued
+// for a CSR have no key stored.
+func tlsKeyMatch(cert cloudh.TlsCert) string {
+	switch {
+	case cert.Csr:
+		return "csr"
+	case cert.KeyMatch == nil:
+		return ""
+	case *cert.KeyMatch:
+		return "yes"
+	}
+	return "no"
+}
+
+// checkTlsCerts returns plugin exit code and output line (with perfdata)
+// for certificates expiring within warning/critical thresholds.
+// Certificate not matching its key is critical.
+func checkTlsCerts(certs []cloudh.TlsCert, warning, critical time.Duration) (int, string) {
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Expiry.Before(certs[j].Expiry) })
+
+	status := checkOk
+	problems := make([]string, 0)
+	perf := make([]string, 0, len(certs))
+	now := time.Now()
+	for _, cert := range certs {
+		left := cert.Expiry.Sub(now)
+		switch {
+		case cert.KeyMatch != nil && !*cert.KeyMatch && !cert.Csr:
+			status = checkCritical
+			problems = append(problems, fmt.Sprintf("%s key does not match certificate", cert.CommonName))
+		case left < critical:
+			status = checkCritical
+			problems = append(problems, fmt.Sprintf("%s expires in %d days", cert.CommonName, cert.DaysLeft))
+		case left < warning:
+			if status < checkWarning {
+				status = checkWarning
+			}
+			problems = append(problems, fmt.Sprintf("%s expires in %d days", cert.CommonName, cert.DaysLeft))
+		}
+		perf = append(perf, fmt.Sprintf("'%s'=%d;%d;%d", cert.CommonName, cert.DaysLeft, int(warning.Hours()/24), int(critical.Hours()/24)))
+	}
+
+	msg := fmt.Sprintf("%d certificates", len(certs))
+	if len(problems) > 0 {
+		msg = strings.Join(problems, ", ")
+	} else if len(certs) > 0 {
+		msg = fmt.Sprintf("%s, nearest expiry in %d days (%s)", msg, certs[0].DaysLeft, certs[0].CommonName)
+	}
+	return status, fmt.Sprintf("TLS %s - %s | %s", checkStatusNames[status], msg, strings.Join(perf, " "))
+}
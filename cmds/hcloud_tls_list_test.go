@@ -0,0 +1,49 @@
+package cmds
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qbart/ohowl/cloudh"
+)
+
+func TestPrintTlsCerts(t *testing.T) {
+	match, mismatch := true, false
+	certs := []cloudh.TlsCert{
+		{CommonName: "a.com", DNS: []string{"a.com"}, Expiry: time.Now(), Path: "/tls/a.com.crt", KeyMatch: &match},
+		{CommonName: "b.com", DNS: []string{"b.com"}, Expiry: time.Now(), Path: "/tls/b.com.crt", KeyMatch: &mismatch},
+		{CommonName: "c.com", DNS: []string{"c.com"}, Expiry: time.Now(), Path: "/tls/c.com.crt", Csr: true},
+	}
+
+	tests := []struct {
+		format  string
+		keys    bool
+		want    []string
+		wantNot []string
+	}{
+		{format: "table", wantNot: []string{"KEY MATCH"}},
+		{format: "table", keys: true, want: []string{"KEY MATCH", "| yes", "| no", "| csr"}},
+		{format: "csv", wantNot: []string{"key_match"}},
+		{format: "csv", keys: true, want: []string{"serial,file,key_match", "a.com.crt,yes", "b.com.crt,no", "c.com.crt,csr"}},
+		{format: "json", want: []string{`"key_match": true`, `"key_match": false`}},
+		{format: "yaml", want: []string{"key_match: true", "key_match: false"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := printTlsCerts(&buf, certs, tt.format, tt.keys); err != nil {
+			t.Fatalf("printTlsCerts(%s, keys=%v) = %v", tt.format, tt.keys, err)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("printTlsCerts(%s, keys=%v) missing %q:\n%s", tt.format, tt.keys, s, buf.String())
+			}
+		}
+		for _, s := range tt.wantNot {
+			if strings.Contains(buf.String(), s) {
+				t.Errorf("printTlsCerts(%s, keys=%v) contains %q:\n%s", tt.format, tt.keys, s, buf.String())
+			}
+		}
+	}
+}
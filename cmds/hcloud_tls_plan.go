@@ -0,0 +1,52 @@
+package cmds
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/qbart/ohowl/cloudh"
+)
+
+// printTlsPlans prints plans for change review, reports whether any plan failed.
+func printTlsPlans(w io.Writer, plans []cloudh.TlsPlan) bool {
+	failed := false
+	for _, plan := range plans {
+		if plan.Err != "" {
+			failed = true
+			fmt.Fprintf(w, "[%s] error: %s\n", plan.Domain, plan.Err)
+			continue
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", plan.Domain, plan.Action, plan.Reason)
+		if plan.Action == cloudh.TlsPlanSkip {
+			continue
+		}
+
+		lines := []struct {
+			name   string
+			values []string
+		}{
+			{"domains", []string{strings.Join(plan.Domains, ", ")}},
+			{"key type", []string{plan.KeyType}},
+			{"issuer", []string{plan.Issuer}},
+			{"account", []string{plan.Account}},
+			{"records", plan.Records},
+			{"writes", plan.Writes},
+			{"deletes", plan.Deletes},
+			{"deploy", plan.Deploy},
+		}
+		for _, l := range lines {
+			for i, v := range l.values {
+				if v == "" {
+					continue
+				}
+				name := l.name + ":"
+				if i > 0 {
+					name = ""
+				}
+				fmt.Fprintf(w, "  %-10s%s\n", name, v)
+			}
+		}
+	}
+	return failed
+}
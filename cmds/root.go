@@ -17,6 +17,7 @@ var (
 func init() {
 	// cmdRoot.AddCommand(cmdAgent)
 	cmdRoot.AddCommand(cmdHCloud)
+	cmdRoot.AddCommand(cmdCa)
 	cmdRoot.AddCommand(cmdTpl)
 }
 
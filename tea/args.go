@@ -2,7 +2,9 @@ package tea
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type EqArgsValidator interface {
@@ -20,6 +22,24 @@ type EqArgsInclusionValidator struct {
 	values []string
 }
 
+type EqArgsAnyPresenceValidator struct {
+	args *EqArgs
+	keys []string
+}
+
+type EqArgsPairsValidator struct {
+	args  *EqArgs
+	key   string
+	sep   string
+	kvSep string
+}
+
+type EqArgsIntValidator struct {
+	args *EqArgs
+	key  string
+	min  int
+}
+
 type EqArgs struct {
 	Raw        map[string]string
 	Errors     []error
@@ -79,6 +99,36 @@ func (a *EqArgs) ValidateInclusion(key string, values []string) {
 	a.validators = append(a.validators, &v)
 }
 
+// ValidateAnyPresence checks at least one of keys is given.
+func (a *EqArgs) ValidateAnyPresence(keys ...string) {
+	v := EqArgsAnyPresenceValidator{
+		args: a,
+		keys: keys,
+	}
+	a.validators = append(a.validators, &v)
+}
+
+// ValidatePairs checks key is a sep separated list of <k><kvSep><v> entries.
+func (a *EqArgs) ValidatePairs(key string, sep string, kvSep string) {
+	v := EqArgsPairsValidator{
+		args:  a,
+		key:   key,
+		sep:   sep,
+		kvSep: kvSep,
+	}
+	a.validators = append(a.validators, &v)
+}
+
+// ValidateInt checks key is an integer not lower than min.
+func (a *EqArgs) ValidateInt(key string, min int) {
+	v := EqArgsIntValidator{
+		args: a,
+		key:  key,
+		min:  min,
+	}
+	a.validators = append(a.validators, &v)
+}
+
 func (a *EqArgs) GetBoolDefault(key string, defaultValue bool) bool {
 	v := a.Raw[key]
 	switch v {
@@ -95,6 +145,39 @@ func (a *EqArgs) GetString(key string) string {
 	return a.Raw[key]
 }
 
+func (a *EqArgs) GetStringDefault(key string, defaultValue string) string {
+	if v, ok := a.Raw[key]; ok && v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+func (a *EqArgs) GetIntDefault(key string, defaultValue int) int {
+	i, err := strconv.Atoi(a.Raw[key])
+	if err != nil {
+		return defaultValue
+	}
+	return i
+}
+
+// GetDurationDefault parses Go duration or number of days (e.g. 14d).
+func (a *EqArgs) GetDurationDefault(key string, defaultValue time.Duration) (time.Duration, error) {
+	v, ok := a.Raw[key]
+	if !ok || v == "" {
+		return defaultValue, nil
+	}
+	if strings.HasSuffix(v, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(v, "d")); err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return defaultValue, fmt.Errorf("%s must be a duration (e.g. 14d, 12h)", key)
+	}
+	return d, nil
+}
+
 func (a *EqArgs) GetStrings(key string, sep string) []string {
 	return strings.Split(a.Raw[key], sep)
 }
@@ -123,3 +206,34 @@ func (v *EqArgsInclusionValidator) Valid() bool {
 
 	return false
 }
+
+func (v *EqArgsAnyPresenceValidator) Valid() bool {
+	for _, k := range v.keys {
+		if _, ok := v.args.Raw[k]; ok {
+			return true
+		}
+	}
+	v.args.Errors = append(v.args.Errors, fmt.Errorf("%s is missing", strings.Join(v.keys, " or ")))
+	return false
+}
+
+func (v *EqArgsPairsValidator) Valid() bool {
+	valid := true
+	for _, entry := range v.args.GetStrings(v.key, v.sep) {
+		kv := strings.SplitN(entry, v.kvSep, 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			v.args.Errors = append(v.args.Errors, fmt.Errorf("%s entry %q must be in <key>%s<value> format", v.key, entry, v.kvSep))
+			valid = false
+		}
+	}
+	return valid
+}
+
+func (v *EqArgsIntValidator) Valid() bool {
+	i, err := strconv.Atoi(v.args.Raw[v.key])
+	if err != nil || i < v.min {
+		v.args.Errors = append(v.args.Errors, fmt.Errorf("%s must be a number not lower than %d", v.key, v.min))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package tea
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileLock is an exclusive advisory lock (flock) held on a file.
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile takes an exclusive lock on path, creating the file when missing.
+// When wait is false and the lock is held by another process nil lock is returned.
+func LockFile(path string, wait bool) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &FileLock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	return ErrCoalesce(err, l.f.Close())
+}
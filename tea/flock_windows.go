@@ -0,0 +1,16 @@
+package tea
+
+import "errors"
+
+// FileLock is not supported on Windows.
+type FileLock struct{}
+
+// LockFile is not supported on Windows.
+func LockFile(path string, wait bool) (*FileLock, error) {
+	return nil, errors.New("File locking is not supported on Windows")
+}
+
+// Unlock is not supported on Windows.
+func (l *FileLock) Unlock() error {
+	return errors.New("File locking is not supported on Windows")
+}
@@ -21,6 +21,10 @@ func (c *Consul) KV() *consulapi.KV {
 	return c.client.KV()
 }
 
+func (c *Consul) Session() *consulapi.Session {
+	return c.client.Session()
+}
+
 func (c *Consul) Register(id string, port int, tags []string, meta map[string]string) error {
 	reg := consulapi.AgentServiceRegistration{
 		ID:   id,
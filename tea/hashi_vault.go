@@ -16,3 +16,7 @@ func NewVault() (*Vault, error) {
 
 	return &Vault{client: client}, nil
 }
+
+func (v *Vault) Logical() *vaultapi.Logical {
+	return v.client.Logical()
+}
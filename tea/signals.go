@@ -8,7 +8,7 @@ import (
 
 // SysCallWait waits for syscalls (INT, TERM, ...)
 func SysCallWait(signals ...os.Signal) {
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, signals...)
 	<-quit
 }
@@ -17,3 +17,29 @@ func SysCallWait(signals ...os.Signal) {
 func SysCallWaitDefault() {
 	SysCallWait(syscall.SIGINT, syscall.SIGTERM)
 }
+
+// SysCallNotify calls fn (once) when any of signals is received.
+// Returned func stops listening.
+func SysCallNotify(fn func(os.Signal), signals ...os.Signal) (stop func()) {
+	quit := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(quit, signals...)
+
+	go func() {
+		select {
+		case sig := <-quit:
+			fn(sig)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(quit)
+		close(done)
+	}
+}
+
+// SysCallNotifyDefault calls fn when INT or TERM signal is received.
+func SysCallNotifyDefault(fn func(os.Signal)) (stop func()) {
+	return SysCallNotify(fn, syscall.SIGINT, syscall.SIGTERM)
+}
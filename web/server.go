@@ -2,17 +2,21 @@ package web
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/hashicorp/vault/api"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/qbart/ohowl/cloudh"
 	"github.com/qbart/ohowl/owl"
 	"github.com/qbart/ohowl/tea"
@@ -25,13 +29,30 @@ type App struct {
 	AclToken          string
 	CertPathPrefix    string
 	AccountPathPrefix string
+	// ChallengePathPrefix is where HTTP-01/TLS-ALPN-01 challenges are kept.
+	ChallengePathPrefix string
+	// TlsAlpnListen enables TLS-ALPN-01 challenge listener (e.g. :443).
+	TlsAlpnListen string
+	// CaPathPrefix enables serving CRL of private CA (see owl ca) at CrlPath.
+	CaPathPrefix string
+	CrlPath      string
 
 	consul *tea.Consul
 	vault  *tea.Vault
 }
 
+var acmeTokenRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 type TfCreateRequest struct {
-	Domains []string `json:"domains,omitempty" binding:"required"`
+	Domains []string `json:"domains,omitempty"`
+	// Csr (PEM) is issued instead of domains, key stays with the caller.
+	Csr string `json:"csr,omitempty"`
+}
+
+type TfDeleteRequest struct {
+	Domain  string `json:"domain,omitempty" binding:"required"`
+	Reason  string `json:"reason,omitempty"`
+	Archive bool   `json:"archive,omitempty"`
 }
 
 func (a *App) Run() {
@@ -44,6 +65,37 @@ func (a *App) Run() {
 	r.GET("/health", func(c *gin.Context) {
 		c.Status(200)
 	})
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	// HTTP-01 challenges written to shared storage by any node
+	r.GET("/.well-known/acme-challenge/:token", func(c *gin.Context) {
+		token := c.Param("token")
+		if !acmeTokenRegexp.MatchString(token) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		fs := cloudh.TlsConsulStorage{KV: a.consul.KV()}
+		keyAuth, err := fs.Read(context.TODO(), cloudh.TlsChallengeKey(a.ChallengePathPrefix, cloudh.TlsChallengeHttp01, token))
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Data(http.StatusOK, "text/plain", keyAuth)
+	})
+
+	// CRL of private CA, signed again when close to expiry
+	if a.CaPathPrefix != "" {
+		r.GET(a.CrlPath, func(c *gin.Context) {
+			ca := cloudh.TlsCa{Storage: &cloudh.TlsConsulStorage{KV: a.consul.KV()}, CaPathPrefix: a.CaPathPrefix}
+			crl, err := ca.CurrentCrl()
+			if err != nil {
+				log.Printf("[ERROR] CRL failed %v", err)
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.Data(http.StatusOK, "application/x-pem-file", crl)
+		})
+	}
 
 	if a.AclToken == "" {
 		log.Printf("[ERROR] No ACL token provided")
@@ -59,12 +111,16 @@ func (a *App) Run() {
 			// C
 			v1.PUT("/certificate", func(c *gin.Context) {
 				var req TfCreateRequest
-				if err := c.ShouldBindJSON(&req); err != nil {
+				if err := c.ShouldBindJSON(&req); err != nil || (len(req.Domains) == 0 && req.Csr == "") {
 					c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "No domains provided"})
 					return
 				}
-				log.Printf("Issue: %s", strings.Join(req.Domains, ","))
-				fs := cloudh.TlsConsulStorage{KV: a.consul.KV()}
+				if req.Csr != "" {
+					log.Printf("Issue: CSR")
+				} else {
+					log.Printf("Issue: %s", strings.Join(req.Domains, ","))
+				}
+				fs := cloudh.TlsConsulStorage{KV: a.consul.KV(), Session: a.consul.Session()}
 				tls := cloudh.AutoTls{
 					Config: cloudh.TlsConfig{
 						DnsToken:          a.DnsToken,
@@ -78,7 +134,13 @@ func (a *App) Run() {
 					AccountStorage: &fs,
 				}
 
-				if err := tls.Issue(); err != nil {
+				var err error
+				if req.Csr != "" {
+					err = tls.IssueCsr([]byte(req.Csr))
+				} else {
+					err = tls.Issue()
+				}
+				if err != nil {
 					c.String(http.StatusUnprocessableEntity, fmt.Sprintf("Issue error: %v", err))
 				} else {
 					c.Status(http.StatusOK)
@@ -93,7 +155,38 @@ func (a *App) Run() {
 			})
 			// D
 			v1.DELETE("/certificate", func(c *gin.Context) {
+				var req TfDeleteRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "No domain provided"})
+					return
+				}
+				if req.Reason == "" {
+					req.Reason = "unspecified"
+				}
+				reason, ok := cloudh.TlsRevocationReasons[req.Reason]
+				if !ok {
+					c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid revocation reason"})
+					return
+				}
+				log.Printf("Revoke: %s", req.Domain)
+				fs := cloudh.TlsConsulStorage{KV: a.consul.KV(), Session: a.consul.Session()}
+				tls := cloudh.AutoTls{
+					Config: cloudh.TlsConfig{
+						Email:             a.DnsEmail,
+						AccountPathPrefix: a.AccountPathPrefix,
+						CertPathPrefix:    a.CertPathPrefix,
+						Debug:             a.Debug,
+						ArchiveRevoked:    req.Archive,
+					},
+					Storage:        &fs,
+					AccountStorage: &fs,
+				}
 
+				if err := tls.Revoke(req.Domain, reason); err != nil {
+					c.String(http.StatusUnprocessableEntity, fmt.Sprintf("Revoke error: %v", err))
+				} else {
+					c.Status(http.StatusOK)
+				}
 			})
 		}
 	}
@@ -107,6 +200,15 @@ func (a *App) Run() {
 	a.consul = consul
 	a.vault = vault
 
+	prometheus.MustRegister(&cloudh.TlsCertCollector{
+		Tls: &cloudh.AutoTls{
+			Config:         cloudh.TlsConfig{CertPathPrefix: a.CertPathPrefix},
+			Storage:        &cloudh.TlsConsulStorage{KV: a.consul.KV()},
+			AccountStorage: &cloudh.TlsNullStorage{},
+		},
+		Storage: "consul",
+	})
+
 	err = consul.Register("OhOwl", 1914, []string{"OhOwl", "oh", "ops"}, map[string]string{"version": owl.Version})
 	if err != nil {
 		log.Fatalf("Consul register failed: %v", err)
@@ -129,6 +231,10 @@ func (a *App) Run() {
 		}
 	}()
 
+	if a.TlsAlpnListen != "" {
+		go a.serveTlsAlpn()
+	}
+
 	tea.SysCallWaitDefault()
 	err = consul.Deregister("OhOwl")
 	if err != nil {
@@ -144,6 +250,51 @@ func (a *App) Run() {
 	}
 }
 
+// serveTlsAlpn answers TLS-ALPN-01 challenges, connections are closed
+// right after the handshake.
+func (a *App) serveTlsAlpn() {
+	fs := cloudh.TlsConsulStorage{KV: a.consul.KV()}
+	ln, err := tls.Listen("tcp", a.TlsAlpnListen, &tls.Config{
+		NextProtos:     []string{tlsalpn01.ACMETLS1Protocol},
+		GetCertificate: cloudh.TlsAlpnGetCertificate(&fs, a.ChallengePathPrefix),
+	})
+	if err != nil {
+		log.Fatalf("TLS-ALPN listener failed %v", err)
+	}
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// back off on temporary errors (e.g. too many open files) like net/http does
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Temporary() {
+				log.Printf("TLS-ALPN listener stopped %v", err)
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("TLS-ALPN accept failed %v, retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.(*tls.Conn).Handshake(); err != nil {
+				log.Printf("TLS-ALPN handshake failed %v", err)
+			}
+		}()
+	}
+}
+
 func OwlAuth(token string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var h OwlAuthHeader